@@ -0,0 +1,25 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bzip2 implements bzip2 decompression.
+//
+// It wraps the standard library compress/bzip2 package,
+// so legacy bzip2 data can be read using the same module as the other formats.
+// Fixes to the standard library decoder apply without changes to this package.
+package bzip2
+
+import (
+	"compress/bzip2"
+	"io"
+)
+
+// NewReader returns an io.Reader which decompresses bzip2 data from r.
+// Concatenated streams, as written by parallel compressors, are decompressed as one stream.
+// Block and stream checksums are verified, and corrupt data returns
+// a compress/bzip2.StructuralError.
+// If r does not also implement io.ByteReader,
+// the decompressor may read more data than necessary from r.
+func NewReader(r io.Reader) io.Reader {
+	return bzip2.NewReader(r)
+}
@@ -0,0 +1,50 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bzip2
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+)
+
+// Streams containing "hello " and "world\n".
+const (
+	helloStream = "425a68393141592653597669e0d4000001110040000244a00030cd00c34629971772453850907669e0d4"
+	worldStream = "425a68393141592653590a580695000002c18000100404908020002218683004e8185dc914e1424029601a54"
+)
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	data := mustDecodeHex(helloStream)
+	// The block CRC follows the stream header and block magic.
+	data[10] ^= 1
+	_, err := io.ReadAll(NewReader(bytes.NewReader(data)))
+	var serr bzip2.StructuralError
+	if !errors.As(err, &serr) || serr != "block checksum mismatch" {
+		t.Fatalf("want block checksum error, got %v", err)
+	}
+}
+
+func TestMultiStream(t *testing.T) {
+	data := mustDecodeHex(helloStream + worldStream)
+	got, err := io.ReadAll(NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello world\n" {
+		t.Fatalf("got %q, want %q", got, "hello world\n")
+	}
+}
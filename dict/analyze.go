@@ -0,0 +1,72 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// CorpusStats contains statistics about a set of samples.
+type CorpusStats struct {
+	// Samples is the number of samples.
+	Samples int
+
+	// TotalBytes is the combined size of all samples.
+	TotalBytes int
+
+	// MinLength, MedianLength and MaxLength are the sample sizes.
+	MinLength, MedianLength, MaxLength int
+
+	// Entropy is the order 0 entropy of the sample bytes in bits per byte.
+	// This estimates the size of the samples with entropy coding alone, without matches.
+	Entropy float64
+
+	// UniqueMatches is the number of distinct HashBytes long sequences in the samples.
+	// Sequences are counted by a 32 bit hash, so very large corpora may be slightly undercounted.
+	// A low number compared to TotalBytes means there is a lot of repetition a dictionary can capture.
+	UniqueMatches int
+}
+
+// AnalyzeSamples returns statistics about the samples, without building a dictionary.
+// Only o.HashBytes is used.
+func AnalyzeSamples(samples [][]byte, o Options) (CorpusStats, error) {
+	if len(samples) == 0 {
+		return CorpusStats{}, ErrNoSamples
+	}
+	if o.HashBytes < 3 || o.HashBytes > 8 {
+		return CorpusStats{}, fmt.Errorf("dict: HashBytes must be between 3 and 8, got %d", o.HashBytes)
+	}
+	s := CorpusStats{Samples: len(samples)}
+	lengths := make([]int, len(samples))
+	var hist [256]int
+	found := make(map[uint32]struct{})
+	for i, b := range samples {
+		lengths[i] = len(b)
+		s.TotalBytes += len(b)
+		for _, v := range b {
+			hist[v]++
+		}
+		for j := 0; j+o.HashBytes <= len(b); j++ {
+			found[hashLen(load64(b, j), 32, uint8(o.HashBytes))] = struct{}{}
+		}
+	}
+	s.UniqueMatches = len(found)
+	sort.Ints(lengths)
+	s.MinLength = lengths[0]
+	s.MedianLength = lengths[len(lengths)/2]
+	s.MaxLength = lengths[len(lengths)-1]
+	if s.TotalBytes > 0 {
+		total := float64(s.TotalBytes)
+		for _, n := range hist {
+			if n > 0 {
+				p := float64(n) / total
+				s.Entropy -= p * math.Log2(p)
+			}
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// benchMinDuration is the minimum time Benchmark spends encoding and decoding.
+const benchMinDuration = 100 * time.Millisecond
+
+// BenchResult contains the result of Benchmark.
+type BenchResult struct {
+	// Size is the total size of the samples.
+	Size int
+
+	// CompressedSize is the total size of the compressed samples.
+	CompressedSize int
+
+	// Ratio is Size divided by CompressedSize.
+	Ratio float64
+
+	// EncodeMBPerSec is the encoding speed in MB/s of input.
+	EncodeMBPerSec float64
+
+	// DecodeMBPerSec is the decoding speed in MB/s of output.
+	DecodeMBPerSec float64
+}
+
+// Benchmark compresses and decompresses each sample with the Zstandard dictionary
+// as a separate frame, and returns the compression ratio and speed.
+// Samples are compressed and decompressed repeatedly for at least 100ms each
+// to measure speed. A single goroutine is used.
+// Dictionaries without the Zstandard magic number are used as raw content.
+// If level is 0, zstd.SpeedBestCompression is used.
+func Benchmark(dict []byte, samples [][]byte, level zstd.EncoderLevel) (BenchResult, error) {
+	var res BenchResult
+	if len(samples) == 0 {
+		return res, ErrNoSamples
+	}
+	if level == 0 {
+		level = zstd.SpeedBestCompression
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1), encoderDict(dict))
+	if err != nil {
+		return res, err
+	}
+	defer enc.Close()
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), decoderDict(dict))
+	if err != nil {
+		return res, err
+	}
+	defer dec.Close()
+
+	compressed := make([][]byte, len(samples))
+	for i, b := range samples {
+		compressed[i] = enc.EncodeAll(b, nil)
+		res.Size += len(b)
+		res.CompressedSize += len(compressed[i])
+	}
+	if res.Size == 0 {
+		return res, errors.New("samples are empty")
+	}
+	res.Ratio = float64(res.Size) / float64(res.CompressedSize)
+
+	var dst []byte
+	start := time.Now()
+	rounds := 0
+	for rounds == 0 || time.Since(start) < benchMinDuration {
+		for _, b := range samples {
+			dst = enc.EncodeAll(b, dst[:0])
+		}
+		rounds++
+	}
+	res.EncodeMBPerSec = mbPerSec(res.Size*rounds, time.Since(start))
+
+	start = time.Now()
+	rounds = 0
+	for rounds == 0 || time.Since(start) < benchMinDuration {
+		for i, b := range compressed {
+			dst, err = dec.DecodeAll(b, dst[:0])
+			if err != nil {
+				return res, err
+			}
+			if rounds == 0 && !bytes.Equal(dst, samples[i]) {
+				return res, errors.New("decompressed output mismatch")
+			}
+		}
+		rounds++
+	}
+	res.DecodeMBPerSec = mbPerSec(res.Size*rounds, time.Since(start))
+	return res, nil
+}
+
+// mbPerSec returns n bytes per d in MB/s.
+func mbPerSec(n int, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds() / 1e6
+}
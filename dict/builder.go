@@ -6,10 +6,14 @@ package dict
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
+	"hash/adler32"
+	"hash/fnv"
 	"io"
+	"math"
+	"math/bits"
 	"math/rand"
 	"sort"
 	"time"
@@ -24,38 +28,454 @@ type match struct {
 	offset int64
 }
 
+// countGroup returns n rounded down to its 6 most significant bits.
+// Counts in the same group are within about 1/32 of each other.
+func countGroup(n uint32) uint32 {
+	shift := bits.Len32(n) - 6
+	if shift <= 0 {
+		return n
+	}
+	return n >> shift << shift
+}
+
+// rankMatches compares the rank of a and b by count group, offset and count.
+// It returns a negative number if a should be selected before b,
+// and 0 if the ranks are equal.
+// Similar counts are grouped and low offsets emitted first,
+// which will keep together strings that are very similar.
+func rankMatches(a, b match) int {
+	if ga, gb := countGroup(a.n), countGroup(b.n); ga != gb {
+		if ga > gb {
+			return -1
+		}
+		return 1
+	}
+	if a.offset != b.offset {
+		if a.offset < b.offset {
+			return -1
+		}
+		return 1
+	}
+	if a.n != b.n {
+		if a.n > b.n {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
 type matchValue struct {
 	value       []byte
 	followBy    map[uint32]uint32
 	preceededBy map[uint32]uint32
 }
 
+// Algorithm selects how dictionary content is chosen from the samples.
+type Algorithm uint8
+
+const (
+	// AlgoHash selects content by counting how many samples contain each hashed match
+	// and joining the most frequent matches into longer strings.
+	// This is the default.
+	AlgoHash Algorithm = iota
+
+	// AlgoCover uses the COVER algorithm.
+	// Segments of SegmentSize bytes are scored by the frequency of the HashBytes long
+	// k-mers they contain, and the best non-overlapping segments are selected greedily.
+	AlgoCover
+
+	// AlgoFastCover is an approximation of AlgoCover that is much faster for large sample sets.
+	// k-mers are hashed into a table of 1<<FastCoverF entries, and
+	// only every FastCoverAccel'th position is counted.
+	AlgoFastCover
+)
+
+// String returns the name of the algorithm.
+func (a Algorithm) String() string {
+	switch a {
+	case AlgoHash:
+		return "hash"
+	case AlgoCover:
+		return "cover"
+	case AlgoFastCover:
+		return "fastcover"
+	}
+	return fmt.Sprintf("Algorithm(%d)", uint8(a))
+}
+
+// Direction selects the direction AlgoHash extends matches into longer strings.
+type Direction uint8
+
+const (
+	// DirForward extends matches with the matches that follow them.
+	// Matches early in the samples are preferred on ties.
+	// This is the default.
+	DirForward Direction = iota
+
+	// DirBackward extends matches with the matches that precede them.
+	// Matches late in the samples are preferred on ties.
+	// This can be better when samples share suffixes rather than prefixes.
+	DirBackward
+
+	// DirBoth selects content in both directions, and keeps the content
+	// that covers the most sample bytes.
+	DirBoth
+)
+
+// String returns the name of the direction.
+func (d Direction) String() string {
+	switch d {
+	case DirForward:
+		return "forward"
+	case DirBackward:
+		return "backward"
+	case DirBoth:
+		return "both"
+	}
+	return fmt.Sprintf("Direction(%d)", uint8(d))
+}
+
+// LogLevel controls how much is written to Options.Output.
+type LogLevel uint8
+
+const (
+	// LogDefault uses LogInfo.
+	LogDefault LogLevel = iota
+
+	// LogSilent writes nothing.
+	LogSilent
+
+	// LogInfo writes progress and a summary of each build step.
+	LogInfo
+
+	// LogDebug writes details of the selected content and of the entropy table generation.
+	LogDebug
+)
+
+var (
+	// ErrNoSamples is returned when no samples are provided.
+	ErrNoSamples = errors.New("no samples provided")
+
+	// ErrSamplesTooSmall is returned when no samples are long enough to be indexed.
+	ErrSamplesTooSmall = errors.New("samples too small")
+
+	// ErrNoBenefit is returned when Options.VerifyBenefit is set and
+	// the dictionary does not reduce the compressed size enough.
+	ErrNoBenefit = errors.New("dictionary does not improve compression")
+
+	// ErrDictSizeTooLarge is returned when Options.MaxDictSize exceeds
+	// the largest supported size or Options.MaxMemoryBytes.
+	ErrDictSizeTooLarge = errors.New("dictionary size too large")
+
+	// ErrDictTooSmall is returned when the built dictionary is smaller than Options.MinDictSize.
+	ErrDictTooSmall = errors.New("dictionary too small")
+
+	// ErrDictCorrupt is returned by ReadDictFileChecksummed when the file is not a valid
+	// checksummed dictionary file, or the checksum does not match.
+	ErrDictCorrupt = errors.New("dictionary file corrupt")
+
+	// ErrLegacyDict is returned when a dictionary uses the format of
+	// Zstandard versions before v0.7, which is not supported.
+	ErrLegacyDict = errors.New("legacy zstd dictionary format")
+)
+
 type Options struct {
 	// MaxDictSize is the max size of the backreference dictionary.
+	// Entropy tables and headers are added to this.
+	// Must be at least 8 and at most 1<<31, the largest Zstandard window.
+	// If MaxMemoryBytes is set, MaxDictSize must not exceed it.
 	MaxDictSize int
 
+	// WindowLog is the log2 of the window size used by the decoder, if > 0.
+	// Content further than the window from the end of the dictionary cannot be referenced,
+	// so MaxDictSize is reduced to 1<<WindowLog, and a warning is written to Output.
+	// Must be 0 or between 10 and 31.
+	WindowLog int
+
+	// PadToMaxDictSize makes the returned dictionary exactly MaxDictSize bytes,
+	// including any header and entropy tables.
+	// Zero bytes are added before the content if it is smaller,
+	// and the start of the content is removed if the tables make it larger.
+	// Padding may slightly reduce compression, but gives dictionaries a fixed size.
+	// S2 dictionaries cannot be padded.
+	PadToMaxDictSize bool
+
+	// MinDictSize is the minimum size of the returned dictionary, including any tables.
+	// If the dictionary is smaller an error wrapping ErrDictTooSmall is returned.
+	// If 0, any size is accepted.
+	MinDictSize int
+
 	// HashBytes is the minimum length to index.
-	// Must be >=4 and <=8
+	// Must be >=3 and <=8
 	HashBytes int
 
-	// Debug output
+	// Algorithm is the algorithm used to select dictionary content.
+	// Default is AlgoHash.
+	Algorithm Algorithm
+
+	// Direction is the direction AlgoHash extends matches into longer strings.
+	// AlgoCover and AlgoFastCover select fixed size segments and ignore this.
+	// Default is DirForward.
+	Direction Direction
+
+	// SegmentSize is the size of the segments selected by AlgoCover and AlgoFastCover.
+	// Must be at least HashBytes. If 0, 256 bytes is used.
+	SegmentSize int
+
+	// FastCoverF is the log2 of the frequency table size used by AlgoFastCover.
+	// Smaller tables are faster, but more k-mers will share an entry.
+	// Must be >= 8 and <= 26. If 0, 20 is used.
+	FastCoverF int
+
+	// FastCoverAccel makes AlgoFastCover only count every n'th position of the samples.
+	// Must be >= 1 and <= 10. If 0, 1 is used, meaning all positions are counted.
+	FastCoverAccel int
+
+	// SearchDepth limits the number of different matches AlgoHash tracks
+	// before and after each match, which are the candidates for extending it into a longer string.
+	// Neighbors are tracked in the order they are first seen.
+	// Lower values are faster, but may produce shorter strings.
+	// If 0, there is no limit. Must not be negative.
+	SearchDepth int
+
+	// ExcludeSequences suppresses candidate segments that contain any of the sequences,
+	// so they are not added to the dictionary.
+	// This can be used to keep content that is known to vary between samples out of the dictionary.
+	// The selected segments are joined, so an excluded sequence may still span two segments.
+	// Sequences must not be empty.
+	ExcludeSequences [][]byte
+
+	// RequiredSegments are always added to the dictionary content, before
+	// the selected segments fill the rest of MaxDictSize.
+	// They are placed at the end of the content, with the first segment furthest from the end.
+	// Selected segments contained in a required segment are skipped.
+	// If the required segments are larger than MaxDictSize an error is returned.
+	// Segments must not be empty.
+	RequiredSegments [][]byte
+
+	// MinSegmentFrequency is the number of distinct samples a candidate segment
+	// must be contained in to be selected. This avoids content that only matches
+	// a few samples, which is most likely to happen with few samples.
+	// Sample weights are not considered.
+	// AlgoCover and AlgoFastCover check the whole segment, so a smaller SegmentSize may be needed.
+	// Checking candidates searches the samples, so builds are slower.
+	// If 0 or 1, segments are not checked.
+	MinSegmentFrequency int
+
+	// Recursive makes BuildZstdDictFromDir read files in subdirectories.
+	Recursive bool
+
+	// MaxSamples will build the dictionary from a random selection of this many samples,
+	// if there are more samples. The order of the samples is preserved unless Shuffle is set.
+	// Samples are selected using Seed or Rand.
+	// If 0, all samples are used.
+	MaxSamples int
+
+	// Shuffle will randomize the order of the samples before building,
+	// using Seed or Rand.
+	Shuffle bool
+
+	// MinSampleSize will remove samples shorter than this before building.
+	// If all samples are removed ErrNoSamples is returned.
+	MinSampleSize int
+
+	// MaxSampleSize will truncate samples longer than this to their first MaxSampleSize bytes.
+	// This avoids a few large samples dominating the dictionary.
+	// If 0, there is no limit.
+	MaxSampleSize int
+
+	// Dedup will remove samples that are identical to an earlier sample before building.
+	// For weighted builds the weights of removed samples are added to the kept sample.
+	// Without weights each distinct sample counts once,
+	// so how often a sample was repeated does not affect the dictionary.
+	// Use BuildZstdDictWeighted to keep the repetitions as weights.
+	Dedup bool
+
+	// RecencyDecay makes recent samples contribute more than older samples.
+	// Samples must be supplied in chronological order, oldest first.
+	// The weight of each sample is multiplied by exp(-RecencyDecay * age),
+	// where age is 0 for the last sample and 1 for the first.
+	// For example 2.3 makes the first sample count about a tenth of the last.
+	// Decay is applied before samples are selected or deduplicated.
+	// If 0, all samples have the same weight. Must be >= 0.
+	RecencyDecay float64
+
+	// NormalizeBySize divides the weight of each sample by its size,
+	// so large samples don't contribute more than small samples.
+	// Sizes are measured after MaxSampleSize is applied.
+	// This is combined with any sample weights and RecencyDecay.
+	// AlgoCover and AlgoFastCover select segments from all parts of the samples,
+	// so large samples will still provide segments in proportion to their size,
+	// and this mostly affects AlgoHash.
+	NormalizeBySize bool
+
+	// WeightByDifficulty multiplies the weight of each sample by how poorly it compresses without a dictionary,
+	// so content from samples that benefit most from a dictionary is preferred.
+	// Samples are compressed with S2 using Concurrency goroutines, and the weight is multiplied by
+	// the compressed size divided by the sample size, measured after MaxSampleSize is applied.
+	// This is combined with any sample weights, RecencyDecay and NormalizeBySize.
+	WeightByDifficulty bool
+
+	// MaxMemoryBytes is an approximate limit of the memory used for counting matches.
+	// If 0, there is no limit.
+	//
+	// AlgoHash removes the less frequent matches when the limit is reached.
+	// Matches that are removed and seen again are counted from zero,
+	// so matches spread evenly over the samples may be undercounted.
+	// AlgoFastCover reduces FastCoverF so the tables fit.
+	// AlgoCover falls back to AlgoFastCover if the index of the samples would exceed the limit.
+	// MaxDictSize must not exceed the limit.
+	//
+	// BuildZstdDictFromReader and BuildZstdDictFromCompressed also keep
+	// a random selection of at most MaxMemoryBytes of samples while reading.
+	MaxMemoryBytes int64
+
+	// Concurrency is the number of goroutines used for indexing samples.
+	// If 0, GOMAXPROCS is used. The output does not depend on the concurrency.
+	Concurrency int
+
+	// TimeBudget limits the time spent building the dictionary, if > 0.
+	// When the budget is exceeded while content is selected, selection stops,
+	// and the dictionary is built from the content selected so far.
+	// At least one segment is always selected, so the result is a valid dictionary.
+	// Indexing the samples and building entropy tables is not interrupted,
+	// so the build can take longer than the budget.
+	// With AutoHashBytes the budget includes building the candidates.
+	// DictStats.BudgetExceeded reports whether selection was stopped.
+	TimeBudget time.Duration
+
+	// Progress is called with the progress of the build, if set.
+	// It is first called while samples are indexed, with total being the number of samples.
+	// Then it is called while content is selected. For AlgoHash total is the number of candidates,
+	// for AlgoCover and AlgoFastCover total is MaxDictSize and done is the number of bytes selected.
+	// done reaches total at the end of each step.
+	//
+	// Progress is called at most once for every 1% of progress.
+	// It may be called from different goroutines, but calls are not concurrent.
+	// It should return quickly, since the build waits for it.
+	Progress func(done, total int)
+
+	// Output receives log messages, if set.
 	Output io.Writer
 
+	// LogLevel selects the messages written to Output.
+	// If LogDefault, LogInfo is used.
+	LogLevel LogLevel
+
 	// ZstdDictID is the Zstd dictionary ID to use.
 	// Leave at zero to generate a random ID.
 	ZstdDictID uint32
 
-	// ZstdDictCompat will make the dictionary compatible with Zstd v1.5.5 and earlier.
+	// AutoDictID will derive the dictionary ID from the dictionary content when ZstdDictID is 0.
+	// Dictionaries with the same content will get the same ID.
+	AutoDictID bool
+
+	// Seed is used to seed random number generation.
+	// Building with the same input and options, including Seed, will produce identical dictionaries.
+	// If Seed is 0, a time based seed is used for generating a random ZstdDictID.
+	Seed int64
+
+	// Rand is used for random number generation, if set.
+	// Seed is ignored when Rand is set.
+	// Rand is not safe for concurrent use, so it must not be shared by concurrent builds.
+	Rand *rand.Rand
+
+	// ZstdDictCompat will make the dictionary compatible with Zstd v1.5.5 and earlier,
+	// by making sure the literal table can encode all symbols these versions expect.
 	// See https://github.com/facebook/zstd/issues/3724
+	//
+	// Zstandard dictionaries always use the layout of "zstd --train":
+	// magic number, dictionary ID, entropy tables, repeat offsets and content.
 	ZstdDictCompat bool
 
+	// VerifyBenefit will make Zstandard builds compress a holdout of 10% of the samples,
+	// selected as by SplitSamples with a fixed seed, with and without the dictionary
+	// before returning it. These samples are not used for building the dictionary.
+	// If the dictionary does not reduce the compressed size by at least MinImprovement,
+	// an error wrapping ErrNoBenefit is returned.
+	VerifyBenefit bool
+
+	// MinImprovement is the minimum fraction the compressed size must be reduced by
+	// when VerifyBenefit is set. For example 0.1 requires the size to be reduced by 10%.
+	// If 0, any reduction is accepted.
+	MinImprovement float64
+
 	// Use the specified encoder level for Zstandard dictionaries.
 	// The dictionary will be built using the specified encoder level,
 	// which will reflect speed and make the dictionary tailored for that level.
 	// If not set zstd.SpeedBestCompression will be used.
 	ZstdLevel zstd.EncoderLevel
 
+	// RawContentOnly will make Zstandard builds return only the dictionary content,
+	// without header and entropy tables.
+	// The result can be used with zstd.WithEncoderDictRaw and zstd.WithDecoderDictRaw.
+	// Since there is no header, ZstdDictID, AutoDictID and ZstdDictCompat cannot be set.
+	RawContentOnly bool
+
+	// ComputeRepeatOffsets will build Zstandard dictionaries with the repeat offsets
+	// most commonly used by the first matches when compressing the samples,
+	// and build the entropy tables using these offsets.
+	// This compresses the samples up to 3 times, but usually improves compression.
+	ComputeRepeatOffsets bool
+
+	// MaxEntropyTableBytes limits the size of the entropy tables of Zstandard dictionaries.
+	// MaxDictSize only limits the content, so the tables are added to it.
+	// If the tables are larger, the dictionary is returned as content only, like RawContentOnly.
+	// 0 means no limit.
+	MaxEntropyTableBytes int
+
+	// AdaptiveEntropy will make Zstandard builds check whether the entropy tables
+	// reduce the compressed size of a holdout of 10% of the samples, selected as by SplitSamples
+	// with a fixed seed, compared to using only the content.
+	// If they don't, the dictionary is returned as content only, like RawContentOnly.
+	// These samples are not used for building the dictionary.
+	// The decision is reported in DictStats.EntropyTablesOmitted.
+	AdaptiveEntropy bool
+
+	// AutoHashBytes will select HashBytes by building dictionaries with
+	// HashBytes 4 to 8 from 90% of the samples, and keeping the value that
+	// compresses the remaining samples the best.
+	// The selected value is reported in DictStats.HashBytes.
+	// Candidates are built concurrently, using up to Concurrency goroutines.
+	AutoHashBytes bool
+
+	// OptimizeForDecodeMemory reduces the content to the highest ranked segments,
+	// which hold 90% of the total score of the selected content.
+	// Lower ranked segments are placed furthest from the end of the content,
+	// so removing them shortens the match distances and the memory decoders need for the dictionary,
+	// but compression is usually slightly worse than with the full content.
+	// The content is kept at MinDictSize or above, and required segments are always kept.
+	// Cannot be used with PadToMaxDictSize.
+	OptimizeForDecodeMemory bool
+
+	// EntropyOnly builds a Zstandard dictionary with entropy tables trained on the samples,
+	// but no content except RequiredSegments. The content is at least 8 bytes, as required by Zstandard.
+	// This can help short samples where matches are rare, but literals and sequences are predictable.
+	// Encoders store blocks without matches uncompressed by default,
+	// so use zstd.WithAllLitEntropyCompression(true) to compress them with the tables.
+	// Cannot be used with RawContentOnly or AdaptiveEntropy.
+	EntropyOnly bool
+
+	// MaxKmerPerSample limits how many times each sample counts a HashBytes long match, if > 0.
+	// This keeps a string repeated many times within a sample, such as a separator,
+	// from crowding out strings found in many samples.
+	// AlgoFastCover counts every occurrence by default.
+	// AlgoHash and AlgoCover always count a match once per sample, so they are not affected.
+	MaxKmerPerSample int
+
+	// HashFunc replaces the hash of the HashBytes long matches counted by AlgoHash and AlgoCover.
+	// The fast default hash may give unrelated matches the same hash,
+	// so a stronger hash can improve the content selected, at the cost of speed.
+	// The function is called with HashBytes bytes and must be safe for concurrent use.
+	// The output depends on the hash, so the same function must be used for reproducible builds.
+	// AlgoFastCover always uses its own hash.
+	HashFunc func(b []byte) uint64
+
 	outFormat int
+	scratch   *buildScratch
+	// deadline is the end of TimeBudget, if set.
+	deadline time.Time
 }
 
 const (
@@ -65,13 +485,50 @@ const (
 )
 
 // BuildZstdDict will build a Zstandard dictionary from the provided input.
+// Use a Builder to reuse memory when building many dictionaries.
+//
+// A single sample gives a dictionary of the strings repeated within it,
+// or of the start of the sample if nothing is repeated.
+// If no samples are long enough to be indexed, ErrSamplesTooSmall is returned.
 func BuildZstdDict(input [][]byte, o Options) ([]byte, error) {
+	return NewBuilder(o).Build(input)
+}
+
+// BuildZstdDictContext will build a Zstandard dictionary from the provided input.
+// If ctx is cancelled the build is aborted and ctx.Err() is returned.
+func BuildZstdDictContext(ctx context.Context, input [][]byte, o Options) ([]byte, error) {
 	o.outFormat = formatZstd
-	if o.ZstdDictID == 0 {
-		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-		o.ZstdDictID = 32768 + uint32(rng.Int31n((1<<31)-32768))
+	return buildDict(ctx, input, nil, o, nil)
+}
+
+// budgetExceeded returns whether the deadline of o.TimeBudget has passed.
+func (o Options) budgetExceeded() bool {
+	return !o.deadline.IsZero() && time.Now().After(o.deadline)
+}
+
+// rand returns o.Rand, or a random number generator seeded by o.Seed.
+func (o Options) rand() *rand.Rand {
+	if o.Rand != nil {
+		return o.Rand
 	}
-	return buildDict(input, o)
+	seed := o.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+// randomDictID returns a random dictionary ID outside the range reserved by Zstandard.
+func randomDictID(rng *rand.Rand) uint32 {
+	return 32768 + uint32(rng.Int31n((1<<31)-32768))
+}
+
+// contentDictID returns a dictionary ID derived from the content,
+// outside the range reserved by Zstandard.
+func contentDictID(content []byte) uint32 {
+	h := fnv.New64a()
+	h.Write(content)
+	return 32768 + uint32(h.Sum64()%((1<<31)-32768))
 }
 
 // BuildS2Dict will build a S2 dictionary from the provided input.
@@ -80,61 +537,500 @@ func BuildS2Dict(input [][]byte, o Options) ([]byte, error) {
 	if o.MaxDictSize > s2.MaxDictSize {
 		return nil, errors.New("max dict size too large")
 	}
-	return buildDict(input, o)
+	return buildDict(context.Background(), input, nil, o, nil)
+}
+
+// MakeS2Dict will build a S2 dictionary from the provided input,
+// and return it ready for use with (*s2.Dict).Encode and (*s2.Dict).Decode.
+// Use BuildS2Dict to get the serialized dictionary.
+func MakeS2Dict(input [][]byte, o Options) (*s2.Dict, error) {
+	b, err := BuildS2Dict(input, o)
+	if err != nil {
+		return nil, err
+	}
+	d := s2.NewDict(b)
+	if d == nil {
+		return nil, errors.New("unable to create s2 dictionary")
+	}
+	return d, nil
 }
 
 // BuildRawDict will build a raw dictionary from the provided input.
 // This can be used for deflate, lz4 and others.
 func BuildRawDict(input [][]byte, o Options) ([]byte, error) {
 	o.outFormat = formatRaw
-	return buildDict(input, o)
+	return buildDict(context.Background(), input, nil, o, nil)
 }
 
-func buildDict(input [][]byte, o Options) ([]byte, error) {
-	matches := make(map[uint32]uint32)
-	offsets := make(map[uint32]int64)
-	var total uint64
+// flateMaxDictSize is the largest dictionary deflate can reference.
+const flateMaxDictSize = 32 << 10
 
-	wantLen := o.MaxDictSize
-	hashBytes := o.HashBytes
+// maxDictSize is the largest MaxDictSize accepted, the largest Zstandard window.
+const maxDictSize = 1 << 31
+
+// BuildFlateDict will build a preset dictionary for deflate from the provided input.
+// The result can be used with flate.NewWriterDict and flate.NewReaderDict.
+//
+// Deflate can only reference the last 32KB of the dictionary,
+// so the size is capped at 32768 bytes.
+// The most valuable content is placed at the end of the dictionary,
+// since it is closest to the data and cheapest to reference.
+func BuildFlateDict(input [][]byte, o Options) ([]byte, error) {
+	o.outFormat = formatRaw
+	if o.MaxDictSize > flateMaxDictSize {
+		o.MaxDictSize = flateMaxDictSize
+	}
+	return buildDict(context.Background(), input, nil, o, nil)
+}
+
+// FlateDictAdler32 returns the Adler-32 checksum of a preset dictionary,
+// as written to zlib streams by deflateSetDictionary and expected by inflateSetDictionary.
+// The checksum covers all of dict, so the dictionary bytes must match exactly
+// on both sides, even if only the last 32KB can be referenced.
+func FlateDictAdler32(dict []byte) uint32 {
+	return adler32.Checksum(dict)
+}
+
+// buildDict builds a dictionary in the output format of o.
+// weights may be nil, meaning all samples have the same weight.
+// If stats is non-nil it will be filled with statistics about the build.
+func buildDict(ctx context.Context, input [][]byte, weights []float64, o Options, stats *DictStats) ([]byte, error) {
+	wantCoverage := stats != nil
+	if stats == nil {
+		stats = &DictStats{}
+	}
+	start := time.Now()
+	defer func() { stats.Timings.Total = time.Since(start) }()
+	if o.TimeBudget > 0 && o.deadline.IsZero() {
+		o.deadline = start.Add(o.TimeBudget)
+	}
+	if o.AutoHashBytes {
+		h, err := chooseHashBytes(ctx, input, weights, o)
+		if err != nil {
+			return nil, err
+		}
+		println, _ := o.printers()
+		println("Selected HashBytes:", h)
+		o.HashBytes = h
+	}
+	input, w, holdout, err := prepareSamples(input, weights, &o, stats)
+	if err != nil {
+		return nil, err
+	}
+	stats.Timings.Prepare = time.Since(start)
+	t := time.Now()
+	content, firstOffsets, err := selectContent(ctx, input, w, o, stats)
+	if err != nil {
+		return nil, err
+	}
+	stats.Timings.Select = time.Since(t) - stats.Timings.Index
+	t = time.Now()
+	out, err := finishChecked(input, holdout, content, firstOffsets, o, stats)
+	if err != nil {
+		return nil, err
+	}
+	stats.Timings.Entropy = time.Since(t)
+	if wantCoverage {
+		stats.Coverage = coverage(content, input, o.HashBytes)
+	}
+	return out, nil
+}
+
+// prepareSamples validates o and applies the options that select and modify samples.
+// Defaults are filled in o.
+// If o.VerifyBenefit applies, samples for verification are returned as holdout.
+func prepareSamples(input [][]byte, weights []float64, o *Options, stats *DictStats) ([][]byte, sampleWeights, [][]byte, error) {
+	if o.scratch == nil {
+		o.scratch = &buildScratch{}
+	}
 	if len(input) == 0 {
-		return nil, fmt.Errorf("no input provided")
+		return nil, nil, nil, ErrNoSamples
 	}
-	if hashBytes < 4 || hashBytes > 8 {
-		return nil, fmt.Errorf("HashBytes must be >= 4 and <= 8")
+	if err := o.validate(); err != nil {
+		return nil, nil, nil, err
 	}
-	println := func(args ...interface{}) {
-		if o.Output != nil {
-			fmt.Fprintln(o.Output, args...)
+	if o.WindowLog != 0 {
+		if window := 1 << o.WindowLog; o.MaxDictSize > window {
+			println, _ := o.printers()
+			println("Warning: MaxDictSize", o.MaxDictSize, "exceeds window size", window, "- reducing to window size")
+			o.MaxDictSize = window
 		}
 	}
-	printf := func(s string, args ...interface{}) {
-		if o.Output != nil {
-			fmt.Fprintf(o.Output, s, args...)
+	if int64(o.MaxDictSize) > maxDictSize {
+		return nil, nil, nil, fmt.Errorf("%w: MaxDictSize %d exceeds %d", ErrDictSizeTooLarge, o.MaxDictSize, int64(maxDictSize))
+	}
+	if o.MaxMemoryBytes > 0 && int64(o.MaxDictSize) > o.MaxMemoryBytes {
+		return nil, nil, nil, fmt.Errorf("%w: MaxDictSize %d exceeds MaxMemoryBytes %d", ErrDictSizeTooLarge, o.MaxDictSize, o.MaxMemoryBytes)
+	}
+	stats.HashBytes = o.HashBytes
+	if o.outFormat == formatZstd {
+		stats.ZstdLevel = o.ZstdLevel
+		if stats.ZstdLevel == 0 {
+			stats.ZstdLevel = zstd.SpeedBestCompression
 		}
 	}
-	found := make(map[uint32]struct{})
-	for i, b := range input {
-		for k := range found {
-			delete(found, k)
+	if n := requiredSize(o.RequiredSegments); n > o.MaxDictSize {
+		return nil, nil, nil, fmt.Errorf("RequiredSegments are %d bytes, exceeding MaxDictSize %d by %d bytes", n, o.MaxDictSize, n-o.MaxDictSize)
+	}
+	if o.OptimizeForDecodeMemory {
+		stats.wantSegments = true
+	}
+	if o.RecencyDecay > 0 {
+		weights = recencyWeights(weights, len(input), o.RecencyDecay)
+	}
+	if o.Algorithm == AlgoCover || o.Algorithm == AlgoFastCover {
+		if o.SegmentSize == 0 {
+			o.SegmentSize = 256
 		}
-		for i := range b {
-			rem := b[i:]
-			if len(rem) < 8 {
-				break
-			}
-			h := hashLen(binary.LittleEndian.Uint64(rem), 32, uint8(hashBytes))
-			if _, ok := found[h]; ok {
-				// Only count first occurrence
-				continue
-			}
-			matches[h]++
-			offsets[h] += int64(i)
-			total++
-			found[h] = struct{}{}
+		if o.SegmentSize < o.HashBytes {
+			return nil, nil, nil, fmt.Errorf("SegmentSize must be >= HashBytes")
+		}
+		if o.FastCoverF == 0 {
+			o.FastCoverF = 20
 		}
-		printf("\r input %d indexed...", i)
+		if o.FastCoverF < 8 || o.FastCoverF > 26 {
+			return nil, nil, nil, fmt.Errorf("FastCoverF must be >= 8 and <= 26")
+		}
+		if o.FastCoverAccel == 0 {
+			o.FastCoverAccel = 1
+		}
+		if o.FastCoverAccel < 1 || o.FastCoverAccel > 10 {
+			return nil, nil, nil, fmt.Errorf("FastCoverAccel must be >= 1 and <= 10")
+		}
+	}
+	if o.Shuffle || (o.MaxSamples > 0 && o.MaxSamples < len(input)) {
+		input, weights = selectSamples(input, weights, o.MaxSamples, o.Shuffle, o.rand())
+	}
+	if o.MinSampleSize > 0 {
+		input, weights = dropSmallSamples(input, weights, o.MinSampleSize, stats)
+		if len(input) == 0 {
+			return nil, nil, nil, ErrNoSamples
+		}
+	}
+	if o.MaxSampleSize > 0 {
+		input = truncateSamples(input, o.MaxSampleSize, stats)
+		if stats.Truncated > 0 {
+			println, _ := o.printers()
+			println("Truncated", stats.Truncated, "samples to", o.MaxSampleSize, "bytes")
+		}
+	}
+	if o.Dedup {
+		n := len(input)
+		input, weights = dedupSamples(input, weights)
+		stats.Duplicates = n - len(input)
+		if stats.Duplicates > 0 {
+			println, _ := o.printers()
+			println("Removed", stats.Duplicates, "duplicate samples")
+		}
+	}
+	var holdout [][]byte
+	if (o.VerifyBenefit || o.AdaptiveEntropy) && o.outFormat == formatZstd && !o.RawContentOnly {
+		input, weights, holdout = splitHoldout(input, weights)
+	}
+	if o.NormalizeBySize {
+		weights = sizeWeights(weights, input)
+	}
+	if o.WeightByDifficulty {
+		weights = difficultyWeights(weights, input, o.concurrency(len(input)))
+	}
+	stats.Samples = len(input)
+	w, err := newSampleWeights(weights)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return input, w, holdout, nil
+}
+
+// validate returns an error if o has invalid values.
+// Options that depend on the samples are checked by prepareSamples.
+func (o Options) validate() error {
+	if o.HashBytes < 3 || o.HashBytes > 8 {
+		return fmt.Errorf("dict: HashBytes must be between 3 and 8, got %d", o.HashBytes)
+	}
+	if o.MaxDictSize < 8 {
+		return fmt.Errorf("dict: MaxDictSize must be at least 8, got %d", o.MaxDictSize)
+	}
+	if o.WindowLog != 0 && (o.WindowLog < 10 || o.WindowLog > 31) {
+		return fmt.Errorf("WindowLog must be between 10 and 31, got %d", o.WindowLog)
+	}
+	if o.MaxKmerPerSample < 0 {
+		return fmt.Errorf("MaxKmerPerSample must be >= 0, got %d", o.MaxKmerPerSample)
+	}
+	if o.SearchDepth < 0 {
+		return fmt.Errorf("SearchDepth must be >= 0, got %d", o.SearchDepth)
+	}
+	if o.MinSegmentFrequency < 0 {
+		return fmt.Errorf("MinSegmentFrequency must be >= 0, got %d", o.MinSegmentFrequency)
+	}
+	for i, seq := range o.ExcludeSequences {
+		if len(seq) == 0 {
+			return fmt.Errorf("ExcludeSequences entry %d is empty", i)
+		}
+	}
+	for i, seg := range o.RequiredSegments {
+		if len(seg) == 0 {
+			return fmt.Errorf("RequiredSegments entry %d is empty", i)
+		}
+	}
+	if o.RecencyDecay < 0 || math.IsNaN(o.RecencyDecay) || math.IsInf(o.RecencyDecay, 0) {
+		return fmt.Errorf("RecencyDecay must be >= 0, got %v", o.RecencyDecay)
+	}
+	if o.PadToMaxDictSize && o.outFormat == formatS2 {
+		return errors.New("PadToMaxDictSize cannot be used with S2 dictionaries")
+	}
+	if o.EntropyOnly && (o.outFormat != formatZstd || o.RawContentOnly || o.AdaptiveEntropy) {
+		return errors.New("EntropyOnly can only be used for Zstandard dictionaries with entropy tables")
+	}
+	if o.OptimizeForDecodeMemory && o.PadToMaxDictSize {
+		return errors.New("OptimizeForDecodeMemory cannot be used with PadToMaxDictSize")
+	}
+	if o.Direction > DirBoth {
+		return fmt.Errorf("unknown direction: %v", o.Direction)
+	}
+	if o.RawContentOnly && (o.ZstdDictID != 0 || o.AutoDictID || o.ZstdDictCompat) {
+		return errors.New("ZstdDictID, AutoDictID and ZstdDictCompat cannot be used with RawContentOnly")
+	}
+	return nil
+}
+
+// selectContent returns the dictionary content selected by the algorithm of o.
+// For AlgoHash the most common offsets of the first entries are returned as well.
+func selectContent(ctx context.Context, input [][]byte, w sampleWeights, o Options, stats *DictStats) ([]byte, []int, error) {
+	var content []byte
+	var firstOffsets []int
+	var err error
+	var split bool
+	required := requiredSize(o.RequiredSegments)
+	if o.EntropyOnly {
+		return entropyOnlyContent(o.RequiredSegments, stats)
+	}
+	o.MaxDictSize -= required
+	if required > 0 && o.MaxDictSize < 8 {
+		// No room for selected content.
+		return addRequired(nil, nil, o.RequiredSegments, stats)
+	}
+	if len(input) == 1 && o.scratch.counts == nil {
+		// Matches are counted once per sample, so a single sample is split into blocks
+		// to find the strings it repeats.
+		input, w = splitBlocks(input[0], singleSampleBlockSize), nil
+		split = true
+	}
+	switch o.Algorithm {
+	case AlgoHash:
+		switch o.Direction {
+		case DirForward:
+			content, firstOffsets, err = hashContent(ctx, input, w, o, stats, false)
+		case DirBackward:
+			content, err = hashContentBackward(ctx, input, w, o, stats)
+		case DirBoth:
+			content, firstOffsets, err = hashContentBoth(ctx, input, w, o, stats)
+		default:
+			return nil, nil, fmt.Errorf("unknown direction: %v", o.Direction)
+		}
+	case AlgoCover, AlgoFastCover:
+		content, err = coverContent(ctx, input, w, o, stats)
+	default:
+		return nil, nil, fmt.Errorf("unknown algorithm: %v", o.Algorithm)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if split {
+		stats.SamplesUsed = 1
+	}
+	if len(content) == 0 && required == 0 && (stats.Excluded > 0 || stats.Infrequent > 0) {
+		return nil, nil, fmt.Errorf("no content selected: %d candidates excluded, %d infrequent", stats.Excluded, stats.Infrequent)
 	}
+	if required > 0 {
+		content, firstOffsets, err = addRequired(content, firstOffsets, o.RequiredSegments, stats)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if o.OptimizeForDecodeMemory {
+		content = decodeMemoryContent(content, o, stats)
+	}
+	return content, firstOffsets, nil
+}
+
+// entropyOnlyContent returns the content used by EntropyOnly.
+// This is the required segments, with zero bytes added before them
+// so the content has the minimum size of 8 bytes.
+func entropyOnlyContent(required [][]byte, stats *DictStats) ([]byte, []int, error) {
+	content, firstOffsets, err := addRequired(nil, nil, required, stats)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(content) < 8 {
+		content = append(make([]byte, 8-len(content)), content...)
+	}
+	return content, firstOffsets, nil
+}
+
+// decodeMemoryScore is the fraction of the total segment score kept by OptimizeForDecodeMemory.
+const decodeMemoryScore = 0.9
+
+// decodeMemoryContent returns the content of the highest ranked segments
+// holding decodeMemoryScore of the total score, and at least o.MinDictSize bytes.
+// Required segments are always kept. stats.segments is reduced to the segments kept.
+func decodeMemoryContent(content []byte, o Options, stats *DictStats) []byte {
+	segs := stats.segments
+	var total float64
+	for _, seg := range segs {
+		total += seg.Score
+	}
+	n := len(o.RequiredSegments)
+	size := requiredSize(o.RequiredSegments)
+	var score float64
+	for n < len(segs) && (score < total*decodeMemoryScore || size < o.MinDictSize) {
+		score += segs[n].Score
+		size += len(segs[n].Content)
+		n++
+	}
+	if n == len(segs) || size < 8 {
+		return content
+	}
+	println, _ := o.printers()
+	println("Reduced content from", len(content), "to", size, "bytes for decode memory")
+	stats.segments = segs[:n]
+	return segmentsContent(stats.segments, size)
+}
+
+// requiredSize returns the total size of the required segments.
+func requiredSize(segs [][]byte) int {
+	n := 0
+	for _, seg := range segs {
+		n += len(seg)
+	}
+	return n
+}
+
+// addRequired appends the required segments to the selected content.
+// firstOffsets are moved to account for the added content.
+// If segments are collected, the required segments are ranked first.
+func addRequired(content []byte, firstOffsets []int, required [][]byte, stats *DictStats) ([]byte, []int, error) {
+	n := requiredSize(required)
+	for i := range firstOffsets {
+		firstOffsets[i] += n
+	}
+	content = append(content[:len(content):len(content)], bytes.Join(required, nil)...)
+	if stats.wantSegments {
+		segs := make([]Segment, 0, len(required)+len(stats.segments))
+		for i := len(required) - 1; i >= 0; i-- {
+			segs = append(segs, Segment{Content: append([]byte(nil), required[i]...)})
+		}
+		stats.segments = append(segs, stats.segments...)
+	}
+	stats.Selected += len(required)
+	return content, firstOffsets, nil
+}
+
+// containedInAny returns whether b is contained in any of seqs.
+func containedInAny(b []byte, seqs [][]byte) bool {
+	for _, seq := range seqs {
+		if bytes.Contains(seq, b) {
+			return true
+		}
+	}
+	return false
+}
+
+// finishChecked converts the content to the output format like finishDict,
+// applies o.AdaptiveEntropy and checks the result against o.VerifyBenefit and o.MinDictSize.
+// holdout contains the samples used for verification.
+func finishChecked(input, holdout [][]byte, content []byte, firstOffsets []int, o Options, stats *DictStats) ([]byte, error) {
+	out, err := finishDict(input, content, firstOffsets, o)
+	if err != nil {
+		return nil, err
+	}
+	if o.AdaptiveEntropy && holdout != nil && bytes.HasPrefix(out, zstdDictMagic) {
+		withTables, _, err := compressedSizes(out, holdout, o.ZstdLevel)
+		if err != nil {
+			return nil, err
+		}
+		contentOnly, _, err := compressedSizes(content, holdout, o.ZstdLevel)
+		if err != nil {
+			return nil, err
+		}
+		println, _ := o.printers()
+		println("Holdout size with entropy tables:", withTables, "content only:", contentOnly)
+		if contentOnly <= withTables {
+			out = content
+		}
+	}
+	stats.EntropyTablesOmitted = o.outFormat == formatZstd && !o.RawContentOnly && !bytes.HasPrefix(out, zstdDictMagic)
+	if o.PadToMaxDictSize {
+		out, content, err = padDict(out, content, o.MaxDictSize, requiredSize(o.RequiredSegments))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if holdout != nil && o.VerifyBenefit {
+		ratio, err := EstimateRatio(out, holdout, o.ZstdLevel)
+		if err != nil {
+			return nil, err
+		}
+		stats.Improvement = 1 - ratio
+		if stats.Improvement <= 0 || stats.Improvement < o.MinImprovement {
+			return nil, fmt.Errorf("%w: size reduced by %.2f%%, minimum is %.2f%%", ErrNoBenefit, stats.Improvement*100, o.MinImprovement*100)
+		}
+	}
+	if len(out) < o.MinDictSize {
+		return nil, fmt.Errorf("%w: %d bytes, minimum is %d", ErrDictTooSmall, len(out), o.MinDictSize)
+	}
+	stats.ContentSize = len(content)
+	stats.TablesSize = len(out) - len(content)
+	stats.EntropyTablesSize = entropyTablesSize(out, content)
+	return out, nil
+}
+
+// singleSampleBlockSize is the size of the blocks a single sample is split into.
+const singleSampleBlockSize = 256
+
+// splitBlocks returns b split into blocks of size bytes.
+// The last block may be shorter.
+func splitBlocks(b []byte, size int) [][]byte {
+	res := make([][]byte, 0, (len(b)+size-1)/size)
+	for len(b) > size {
+		res = append(res, b[:size])
+		b = b[size:]
+	}
+	return append(res, b)
+}
+
+// hashContent returns the dictionary content selected by AlgoHash,
+// as well as the most common offsets of the first entries.
+// If reverse is set, the samples have been reversed, and the selected strings
+// are reversed back before they are written. No offsets are returned.
+func hashContent(ctx context.Context, input [][]byte, weights sampleWeights, o Options, stats *DictStats, reverse bool) ([]byte, []int, error) {
+	wantLen := o.MaxDictSize
+	hashBytes := o.HashBytes
+	hash := o.hasher()
+	// toDelBuf holds the end of the current string and the next value.
+	var toDelBuf [16 + 8]byte
+	println, printf := o.printers()
+	debugln, debugf := o.debugPrinters()
+	debug := o.logLevel() >= LogDebug
+
+	start := time.Now()
+	counts := o.scratch.counts
+	if counts == nil {
+		var err error
+		counts, err = countHashes(ctx, input, weights, hash, o.concurrency(len(input)), o.MaxMemoryBytes, o.scratch, o.progress(len(input)))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	stats.Timings.Index += time.Since(start)
+	matches, offsets, total := counts.matches, counts.offsets, counts.total
+	stats.SamplesUsed = counts.used
+	if len(matches) == 0 {
+		return nil, nil, ErrSamplesTooSmall
+	}
+	printf("\r %d inputs indexed...", len(input))
 	threshold := uint32(total / uint64(len(matches)))
 	println("\nTotal", total, "match", len(matches), "avg", threshold)
 	sorted := make([]match, 0, len(matches)/2)
@@ -144,41 +1040,53 @@ func buildDict(input [][]byte, o Options) ([]byte, error) {
 		}
 		sorted = append(sorted, match{hash: k, n: v, offset: offsets[k]})
 	}
+	if len(sorted) == 0 {
+		// All matches are equally frequent, so use them all.
+		for k, v := range matches {
+			sorted = append(sorted, match{hash: k, n: v, offset: offsets[k]})
+		}
+	}
+	// The order must be total, so the result doesn't depend on the sort implementation.
+	// Equal ranks are ordered by hash, until the content is known below.
 	sort.Slice(sorted, func(i, j int) bool {
-		if true {
-			// Group very similar counts together and emit low offsets first.
-			// This will keep together strings that are very similar.
-			deltaN := int(sorted[i].n) - int(sorted[j].n)
-			if deltaN < 0 {
-				deltaN = -deltaN
-			}
-			if uint32(deltaN) < sorted[i].n/32 {
-				return sorted[i].offset < sorted[j].offset
-			}
-		} else {
-			if sorted[i].n == sorted[j].n {
-				return sorted[i].offset < sorted[j].offset
-			}
+		if r := rankMatches(sorted[i], sorted[j]); r != 0 {
+			return r < 0
 		}
-		return sorted[i].n > sorted[j].n
+		return sorted[i].hash < sorted[j].hash
 	})
 	println("Sorted len:", len(sorted))
+	stats.Candidates = len(sorted)
+	for _, m := range sorted {
+		stats.addScore(weights.unscale(uint64(m.n)))
+	}
 	if len(sorted) > wantLen {
 		sorted = sorted[:wantLen]
 	}
 	lowestOcc := sorted[len(sorted)-1].n
 	println("Cropped len:", len(sorted), "Lowest occurrence:", lowestOcc)
 
-	wantMatches := make(map[uint32]uint32, len(sorted))
+	wantMatches := o.scratch.getWantMatches(len(sorted))
 	for _, v := range sorted {
 		wantMatches[v.hash] = v.n
 	}
 
-	output := make(map[uint32]matchValue, len(sorted))
+	// canAdd returns whether h can be counted as a neighbor in m.
+	canAdd := func(m map[uint32]uint32, h uint32) bool {
+		if o.SearchDepth <= 0 || len(m) < o.SearchDepth {
+			return true
+		}
+		_, ok := m[h]
+		return ok
+	}
+	output := o.scratch.getOutput(len(sorted), hashBytes)
 	var remainCnt [256]int
 	var remainTotal int
 	var firstOffsets []int
 	for i, b := range input {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		w := weights.get(i)
 		for i := range b {
 			rem := b[i:]
 			if len(rem) < 8 {
@@ -189,7 +1097,7 @@ func buildDict(input [][]byte, o Options) ([]byte, error) {
 				prev = b[i-hashBytes:]
 			}
 
-			h := hashLen(binary.LittleEndian.Uint64(rem), 32, uint8(hashBytes))
+			h := hash(rem)
 			if _, ok := wantMatches[h]; !ok {
 				remainCnt[rem[0]]++
 				remainTotal++
@@ -197,39 +1105,61 @@ func buildDict(input [][]byte, o Options) ([]byte, error) {
 			}
 			mv := output[h]
 			if len(mv.value) == 0 {
-				var tmp = make([]byte, hashBytes)
-				copy(tmp[:], rem)
-				mv.value = tmp[:]
+				mv.value = o.scratch.getValue(rem, hashBytes)
 			}
 			if mv.followBy == nil {
-				mv.followBy = make(map[uint32]uint32, 4)
-				mv.preceededBy = make(map[uint32]uint32, 4)
+				mv.followBy = o.scratch.getNeighbors()
+				mv.preceededBy = o.scratch.getNeighbors()
 			}
 			if len(rem) > hashBytes+8 {
 				// Check if we should add next as well.
-				hNext := hashLen(binary.LittleEndian.Uint64(rem[hashBytes:]), 32, uint8(hashBytes))
-				if _, ok := wantMatches[hNext]; ok {
-					mv.followBy[hNext]++
+				hNext := hash(rem[hashBytes:])
+				if _, ok := wantMatches[hNext]; ok && canAdd(mv.followBy, hNext) {
+					mv.followBy[hNext] += w
 				}
 			}
 			if len(prev) >= 8 {
 				// Check if we should prev next as well.
-				hPrev := hashLen(binary.LittleEndian.Uint64(prev), 32, uint8(hashBytes))
-				if _, ok := wantMatches[hPrev]; ok {
-					mv.preceededBy[hPrev]++
+				hPrev := hash(prev)
+				if _, ok := wantMatches[hPrev]; ok && canAdd(mv.preceededBy, hPrev) {
+					mv.preceededBy[hPrev] += w
 				}
 			}
 			output[h] = mv
 		}
-		printf("\rinput %d re-indexed...", i)
+		if debug {
+			debugf("\rinput %d re-indexed...", i)
+		}
 	}
-	println("")
+	debugln("")
+	// Order equal ranks by content.
+	sort.Slice(sorted, func(i, j int) bool {
+		if r := rankMatches(sorted[i], sorted[j]); r != 0 {
+			return r < 0
+		}
+		if c := bytes.Compare(output[sorted[i].hash].value, output[sorted[j].hash].value); c != 0 {
+			return c < 0
+		}
+		return sorted[i].hash < sorted[j].hash
+	})
 	dst := make([][]byte, 0, wantLen/hashBytes)
+	var sortedPrev, sortedFollow []match
+	scores := make([]uint32, 0, wantLen/hashBytes)
 	added := 0
 	const printUntil = 500
+	selectProgress := o.progress(len(sorted))
 	for i, e := range sorted {
+		selectProgress.add(1)
 		if added > o.MaxDictSize {
-			println("Ending. Next Occurrence:", e.n)
+			debugln("Ending. Next Occurrence:", e.n)
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		if len(dst) > 0 && o.budgetExceeded() {
+			println("Time budget exceeded after", len(dst), "segments")
+			stats.BudgetExceeded = true
 			break
 		}
 		m, ok := output[e.hash]
@@ -244,7 +1174,7 @@ func buildDict(input [][]byte, o Options) ([]byte, error) {
 
 		var tmp = make([]byte, 0, hashBytes*2)
 		{
-			sortedPrev := make([]match, 0, len(m.followBy))
+			sortedPrev = sortedPrev[:0]
 			for k, v := range m.preceededBy {
 				if _, ok := output[k]; v < wantLen || !ok {
 					continue
@@ -256,6 +1186,9 @@ func buildDict(input [][]byte, o Options) ([]byte, error) {
 			}
 			if len(sortedPrev) > 0 {
 				sort.Slice(sortedPrev, func(i, j int) bool {
+					if sortedPrev[i].n == sortedPrev[j].n {
+						return sortedPrev[i].hash < sortedPrev[j].hash
+					}
 					return sortedPrev[i].n > sortedPrev[j].n
 				})
 				bestPrev := output[sortedPrev[0].hash]
@@ -265,7 +1198,6 @@ func buildDict(input [][]byte, o Options) ([]byte, error) {
 		tmp = append(tmp, m.value...)
 		delete(output, e.hash)
 
-		sortedFollow := make([]match, 0, len(m.followBy))
 		for {
 			var nh uint32 // Next hash
 			stopAfter := false
@@ -286,9 +1218,7 @@ func buildDict(input [][]byte, o Options) ([]byte, error) {
 					// Extremely small impact, but helps longer hashes a bit.
 					const stepBack = 2
 					if stepBack > 0 && len(tmp) >= hashBytes+stepBack {
-						var t8 [8]byte
-						copy(t8[:], tmp[len(tmp)-hashBytes-stepBack:])
-						m, ok = output[hashLen(binary.LittleEndian.Uint64(t8[:]), 32, uint8(hashBytes))]
+						m, ok = output[hash(tmp[len(tmp)-hashBytes-stepBack:])]
 						if ok && len(m.followBy) > 0 {
 							found := []byte(nil)
 							for k := range m.followBy {
@@ -301,28 +1231,33 @@ func buildDict(input [][]byte, o Options) ([]byte, error) {
 							}
 							if found != nil {
 								tmp = tmp[:len(tmp)-stepBack]
-								printf("Step back: %q +  %q\n", string(tmp), string(found))
+								if debug {
+									debugf("Step back: %q +  %q\n", string(tmp), string(found))
+								}
 								continue
 							}
 						}
 						break
 					} else {
-						if i < printUntil {
-							printf("FOLLOW: none after %q\n", string(m.value))
+						if i < printUntil && debug {
+							debugf("FOLLOW: none after %q\n", string(m.value))
 						}
 					}
 					break
 				}
 				sort.Slice(sortedFollow, func(i, j int) bool {
 					if sortedFollow[i].n == sortedFollow[j].n {
+						if sortedFollow[i].offset == sortedFollow[j].offset {
+							return sortedFollow[i].hash < sortedFollow[j].hash
+						}
 						return sortedFollow[i].offset > sortedFollow[j].offset
 					}
 					return sortedFollow[i].n > sortedFollow[j].n
 				})
 				nh = sortedFollow[0].hash
 				stopAfter = sortedFollow[0].n < wantLen
-				if stopAfter && i < printUntil {
-					printf("FOLLOW: %d < %d after %q. Stopping after this.\n", sortedFollow[0].n, wantLen, string(m.value))
+				if stopAfter && i < printUntil && debug {
+					debugf("FOLLOW: %d < %d after %q. Stopping after this.\n", sortedFollow[0].n, wantLen, string(m.value))
 				}
 			}
 			m, ok = output[nh]
@@ -331,11 +1266,12 @@ func buildDict(input [][]byte, o Options) ([]byte, error) {
 			}
 			if len(tmp) > 0 {
 				// Delete all hashes that are in the current string to avoid stuttering.
-				var toDel [16 + 8]byte
-				copy(toDel[:], tmp[len(tmp)-hashBytes:])
+				toDelBuf = [16 + 8]byte{}
+				toDel := toDelBuf[:]
+				copy(toDel, tmp[len(tmp)-hashBytes:])
 				copy(toDel[hashBytes:], m.value)
 				for i := range toDel[:hashBytes*2] {
-					delete(output, hashLen(binary.LittleEndian.Uint64(toDel[i:]), 32, uint8(hashBytes)))
+					delete(output, hash(toDel[i:]))
 				}
 			}
 			tmp = append(tmp, m.value...)
@@ -345,25 +1281,33 @@ func buildDict(input [][]byte, o Options) ([]byte, error) {
 				break
 			}
 		}
-		if i < printUntil {
-			printf("ENTRY %d: %q (%d occurrences, cutoff %d)\n", i, string(tmp), e.n, wantLen)
+		if i < printUntil && debug {
+			debugf("ENTRY %d: %q (%d occurrences, cutoff %d)\n", i, string(tmp), e.n, wantLen)
 		}
 		// Delete substrings already added.
 		if len(tmp) > hashBytes {
 			for j := range tmp[:len(tmp)-hashBytes+1] {
-				var t8 [8]byte
-				copy(t8[:], tmp[j:])
-				if i < printUntil {
-					//printf("* POST DELETE %q\n", string(t8[:hashBytes]))
-				}
-				delete(output, hashLen(binary.LittleEndian.Uint64(t8[:]), 32, uint8(hashBytes)))
+				delete(output, hash(tmp[j:]))
 			}
 		}
+		if containedInAny(tmp, o.RequiredSegments) {
+			continue
+		}
+		if containsAny(tmp, o.ExcludeSequences) {
+			debugf("EXCLUDED %d: %q\n", i, string(tmp))
+			stats.Excluded++
+			continue
+		}
+		if !frequentEnough(tmp, input, o.MinSegmentFrequency) {
+			stats.Infrequent++
+			continue
+		}
 		dst = append(dst, tmp)
+		scores = append(scores, e.n)
 		added += len(tmp)
 		// Find offsets
 		// TODO: This can be better if done as a global search.
-		if len(firstOffsets) < 3 {
+		if len(firstOffsets) < 3 && !reverse {
 			if len(tmp) > 16 {
 				tmp = tmp[:16]
 			}
@@ -397,7 +1341,7 @@ func buildDict(input [][]byte, o Options) ([]byte, error) {
 			}
 			if maxCnt > 1 {
 				firstOffsets = append(firstOffsets, maxOffset+added)
-				println(" - Offset:", len(firstOffsets), "at", maxOffset+added, "count:", maxCnt, "total added:", added, "src index", maxOffset)
+				debugln(" - Offset:", len(firstOffsets), "at", maxOffset+added, "count:", maxCnt, "total added:", added, "src index", maxOffset)
 			}
 		}
 	}
@@ -414,18 +1358,63 @@ func buildDict(input [][]byte, o Options) ([]byte, error) {
 			break
 		}
 	}
+	stats.Selected = len(dst)
+	if reverse {
+		for _, b := range dst {
+			reverseBytes(b)
+		}
+	}
+	if stats.wantSegments {
+		for i, b := range dst {
+			stats.segments = append(stats.segments, Segment{Content: b, Score: weights.unscale(uint64(scores[i]))})
+		}
+	}
 	// Write in reverse order.
 	for i := range dst {
 		toWrite := dst[len(dst)-i-1]
 		out.Write(toWrite)
 	}
-	if o.outFormat == formatRaw {
-		return out.Bytes(), nil
+	selectProgress.finish()
+	return out.Bytes(), firstOffsets, nil
+}
+
+// padDict returns the dictionary out resized to size, and its content.
+// Zero bytes are added before content, or the start of content is removed.
+// The tables before content are kept, so content must be the end of out.
+// At least required bytes of content are kept.
+func padDict(out, content []byte, size, required int) ([]byte, []byte, error) {
+	tables := len(out) - len(content)
+	n := size - tables
+	if n < 8 || n < required {
+		return nil, nil, fmt.Errorf("MaxDictSize %d cannot fit %d bytes of tables and the required content", size, tables)
+	}
+	padded := make([]byte, size)
+	copy(padded, out[:tables])
+	if n >= len(content) {
+		copy(padded[size-len(content):], content)
+	} else {
+		copy(padded[tables:], content[len(content)-n:])
+	}
+	if tables > 0 {
+		// Repeat offsets may point beyond the content if it was shortened.
+		if err := Validate(padded); err != nil {
+			return nil, nil, fmt.Errorf("padding dictionary: %w", err)
+		}
+	}
+	return padded, padded[tables:], nil
+}
+
+// finishDict converts the selected content to the output format.
+// firstOffsets are offsets from the end of content likely to be used first.
+func finishDict(input [][]byte, content []byte, firstOffsets []int, o Options) ([]byte, error) {
+	println, _ := o.printers()
+	if o.outFormat == formatRaw || (o.outFormat == formatZstd && o.RawContentOnly) {
+		return content, nil
 	}
 
 	if o.outFormat == formatS2 {
 		dOff := 0
-		dBytes := out.Bytes()
+		dBytes := content
 		if len(dBytes) > s2.MaxDictSize {
 			dBytes = dBytes[:s2.MaxDictSize]
 		}
@@ -446,21 +1435,289 @@ func buildDict(input [][]byte, o Options) ([]byte, error) {
 
 	offsetsZstd := [3]int{1, 4, 8}
 	for i, off := range firstOffsets {
-		if i >= 3 || off == 0 || off >= out.Len() {
+		if i >= 3 || off == 0 || off >= len(content) {
 			break
 		}
 		offsetsZstd[i] = off
 	}
+	if o.ZstdDictID == 0 {
+		if o.AutoDictID {
+			o.ZstdDictID = contentDictID(content)
+		} else {
+			o.ZstdDictID = randomDictID(o.rand())
+		}
+	}
 	println("\nCompressing. Offsets:", offsetsZstd)
-	return zstd.BuildDict(zstd.BuildDictOptions{
+	var zstdDebugOut io.Writer
+	if o.logLevel() >= LogDebug {
+		zstdDebugOut = o.Output
+	}
+	bo := zstd.BuildDictOptions{
 		ID:         o.ZstdDictID,
 		Contents:   input,
-		History:    out.Bytes(),
+		History:    content,
 		Offsets:    offsetsZstd,
 		CompatV155: o.ZstdDictCompat,
 		Level:      o.ZstdLevel,
-		DebugOut:   o.Output,
+		DebugOut:   zstdDebugOut,
+	}
+	dict, err := zstd.BuildDict(bo)
+	if err != nil {
+		return nil, err
+	}
+	// The dictionary gets the most used offsets,
+	// but the tables were built using the previous offsets.
+	// Rebuild until they match.
+	for pass := 1; pass < 3 && o.ComputeRepeatOffsets; pass++ {
+		d, err := zstd.InspectDictionary(dict)
+		if err != nil {
+			return nil, err
+		}
+		if d.Offsets() == bo.Offsets {
+			break
+		}
+		bo.Offsets = d.Offsets()
+		println("Rebuilding with offsets:", bo.Offsets)
+		dict, err = zstd.BuildDict(bo)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if n := entropyTablesSize(dict, content); o.MaxEntropyTableBytes > 0 && n > o.MaxEntropyTableBytes {
+		println("Entropy tables are", n, "bytes, more than", o.MaxEntropyTableBytes, "- omitting tables")
+		return content, nil
+	}
+	return dict, nil
+}
+
+// containsAny returns whether b contains any of seqs.
+func containsAny(b []byte, seqs [][]byte) bool {
+	for _, seq := range seqs {
+		if bytes.Contains(b, seq) {
+			return true
+		}
+	}
+	return false
+}
+
+// sampleFrequency returns the number of samples containing b.
+// If limit > 0, counting stops when limit is reached.
+func sampleFrequency(b []byte, input [][]byte, limit int) int {
+	n := 0
+	for _, sample := range input {
+		if bytes.Contains(sample, b) {
+			n++
+			if n == limit {
+				break
+			}
+		}
+	}
+	return n
+}
+
+// frequentEnough returns whether b is contained in at least minFreq samples.
+func frequentEnough(b []byte, input [][]byte, minFreq int) bool {
+	return minFreq <= 1 || sampleFrequency(b, input, minFreq) >= minFreq
+}
+
+// zstdDictOverhead is the size of the magic number, ID and repeat offsets of a Zstandard dictionary.
+const zstdDictOverhead = 8 + 12
+
+// entropyTablesSize returns the size of the entropy tables of a dictionary with the given content.
+// Dictionaries without tables return 0.
+func entropyTablesSize(dict, content []byte) int {
+	if len(dict) < len(content)+zstdDictOverhead || !bytes.HasPrefix(dict, zstdDictMagic) {
+		return 0
+	}
+	return len(dict) - len(content) - zstdDictOverhead
+}
+
+// hashCounts contains the number of samples containing each hash.
+type hashCounts struct {
+	matches map[uint32]uint32
+	// offsets contains the sum of the first offset of each hash in the samples.
+	offsets map[uint32]int64
+	total   uint64
+	used    int
+
+	// sorted is reused by prune.
+	sorted []match
+}
+
+// hashCountBytes is the approximate memory used per hash in hashCounts.
+const hashCountBytes = 48
+
+// reset removes all counts, keeping the maps for reuse.
+func (c *hashCounts) reset() {
+	for k := range c.matches {
+		delete(c.matches, k)
+	}
+	for k := range c.offsets {
+		delete(c.offsets, k)
+	}
+	c.total = 0
+	c.used = 0
+}
+
+// prune removes the less frequent hashes if there are more than maxEntries,
+// keeping the maxEntries/2 most frequent, but at least one.
+// Hashes with equal counts are kept in hash order, so the result only depends on the counts.
+func (c *hashCounts) prune(maxEntries int) {
+	if maxEntries <= 0 || len(c.matches) <= maxEntries {
+		return
+	}
+	sorted := c.sorted[:0]
+	for h, n := range c.matches {
+		sorted = append(sorted, match{hash: h, n: n})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].n != sorted[j].n {
+			return sorted[i].n > sorted[j].n
+		}
+		return sorted[i].hash < sorted[j].hash
 	})
+	keep := maxEntries / 2
+	if keep < 1 {
+		keep = 1
+	}
+	for _, m := range sorted[keep:] {
+		delete(c.matches, m.hash)
+		delete(c.offsets, m.hash)
+		c.total -= uint64(m.n)
+	}
+	c.sorted = sorted[:0]
+}
+
+// add counts the hashes of sample b with weight w.
+// Only the first occurrence of a hash in b is counted.
+// found is used for tracking hashes seen in b.
+func (c *hashCounts) add(b []byte, w uint32, hash func([]byte) uint32, found map[uint32]struct{}) {
+	for k := range found {
+		delete(found, k)
+	}
+	if len(b) >= 8 {
+		c.used++
+	}
+	for i := range b {
+		rem := b[i:]
+		if len(rem) < 8 {
+			break
+		}
+		h := hash(rem)
+		if _, ok := found[h]; ok {
+			// Only count first occurrence
+			continue
+		}
+		c.matches[h] += w
+		c.offsets[h] += int64(i)
+		c.total += uint64(w)
+		found[h] = struct{}{}
+	}
+}
+
+// countHashes counts hashes of all input using the specified number of goroutines.
+// Only the first occurrence of a hash in each sample is counted.
+// If maxMemory is > 0 the less frequent hashes are removed to keep memory use below.
+// Samples are then counted in batches of about half the maximum number of hashes
+// in sample bytes, and pruned after each batch, so the result does not depend on concurrency.
+// Progress is reported to p, if non-nil.
+func countHashes(ctx context.Context, input [][]byte, weights sampleWeights, hash func([]byte) uint32, concurrency int, maxMemory int64, s *buildScratch, p *progress) (*hashCounts, error) {
+	maxEntries := 0
+	if maxMemory > 0 {
+		maxEntries = int(maxMemory / hashCountBytes)
+		if maxEntries < 1 {
+			maxEntries = 1
+		}
+	}
+	shards := s.getHashShards(concurrency)
+	res := &shards[0].counts
+	for start := 0; start < len(input); {
+		end := len(input)
+		if maxEntries > 0 {
+			end = start + 1
+			for n := len(input[start]); end < len(input) && n < maxEntries/2; end++ {
+				n += len(input[end])
+			}
+		}
+		batch := input[start:end]
+		workers := concurrency
+		if workers > len(batch) {
+			workers = len(batch)
+		}
+		err := runShards(ctx, len(batch), workers, func(shard, from, to int) error {
+			c := &shards[shard].counts
+			if shard > 0 {
+				c.reset()
+			}
+			found := shards[shard].found
+			for i, b := range batch[from:to] {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				c.add(b, weights.get(start+from+i), hash, found)
+				p.add(1)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Merge into the first shard.
+		for _, sh := range shards[1:workers] {
+			c := &sh.counts
+			for k, v := range c.matches {
+				res.matches[k] += v
+			}
+			for k, v := range c.offsets {
+				res.offsets[k] += v
+			}
+			res.total += c.total
+			res.used += c.used
+		}
+		res.prune(maxEntries)
+		start = end
+	}
+	return res, nil
+}
+
+// logLevel returns the effective log level of o.
+func (o Options) logLevel() LogLevel {
+	if o.Output == nil {
+		return LogSilent
+	}
+	if o.LogLevel == LogDefault {
+		return LogInfo
+	}
+	return o.LogLevel
+}
+
+// printers returns functions that write output to o.Output,
+// if the log level is at least LogInfo.
+func (o Options) printers() (println func(args ...interface{}), printf func(s string, args ...interface{})) {
+	return o.levelPrinters(LogInfo)
+}
+
+// debugPrinters returns functions that write output to o.Output,
+// if the log level is at least LogDebug.
+func (o Options) debugPrinters() (println func(args ...interface{}), printf func(s string, args ...interface{})) {
+	return o.levelPrinters(LogDebug)
+}
+
+// levelPrinters returns functions that write output to o.Output,
+// if the log level is at least level.
+func (o Options) levelPrinters(level LogLevel) (println func(args ...interface{}), printf func(s string, args ...interface{})) {
+	enabled := o.logLevel() >= level
+	println = func(args ...interface{}) {
+		if enabled {
+			fmt.Fprintln(o.Output, args...)
+		}
+	}
+	printf = func(s string, args ...interface{}) {
+		if enabled {
+			fmt.Fprintf(o.Output, s, args...)
+		}
+	}
+	return println, printf
 }
 
 const (
@@ -472,13 +1729,30 @@ const (
 	prime8bytes = 0xcf1bbcdcb7a56463
 )
 
+// hasher returns the function used for hashing the HashBytes long match at the start of b.
+// If b is shorter than 8 bytes, it is zero padded.
+func (o Options) hasher() func(b []byte) uint32 {
+	n := o.HashBytes
+	if f := o.HashFunc; f != nil {
+		return func(b []byte) uint32 {
+			h := f(b[:n])
+			return uint32(h>>32) ^ uint32(h)
+		}
+	}
+	return func(b []byte) uint32 {
+		return hashLen(load64(b, 0), 32, uint8(n))
+	}
+}
+
 // hashLen returns a hash of the lowest l bytes of u for a size size of h bytes.
-// l must be >=4 and <=8. Any other value will return hash for 4 bytes.
+// l must be >=3 and <=8. Any other value will return hash for 4 bytes.
 // h should always be <32.
 // Preferably h and l should be a constant.
 // LENGTH 4 is passed straight through
 func hashLen(u uint64, hashLog, mls uint8) uint32 {
 	switch mls {
+	case 3:
+		return hash3(uint32(u), hashLog)
 	case 5:
 		return hash5(u, hashLog)
 	case 6:
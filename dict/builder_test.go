@@ -0,0 +1,3312 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/huff0"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+)
+
+// testSamples returns n JSON like samples generated from seed.
+func testSamples(n int, seed int64) [][]byte {
+	rng := rand.New(rand.NewSource(seed))
+	names := []string{"alice", "bob", "carol", "dave", "eve", "frank", "grace"}
+	res := make([][]byte, n)
+	for i := range res {
+		res[i] = []byte(fmt.Sprintf(`{"id":%d,"name":%q,"email":"%s@example.com","active":%v,"score":%d,"tags":["alpha","beta"],"created":"2023-01-%02dT%02d:00:00Z"}`,
+			rng.Intn(100000), names[rng.Intn(len(names))], names[rng.Intn(len(names))], rng.Intn(2) == 0, rng.Intn(1000), rng.Intn(28)+1, rng.Intn(24)))
+	}
+	return res
+}
+
+func TestBuildDeterministic(t *testing.T) {
+	input := testSamples(1000, 1)
+	for _, algo := range []Algorithm{AlgoHash, AlgoCover, AlgoFastCover} {
+		t.Run(algo.String(), func(t *testing.T) {
+			o := Options{MaxDictSize: 2048, HashBytes: 6, Algorithm: algo, Seed: 42, ZstdLevel: zstd.SpeedDefault}
+			a, err := BuildZstdDict(input, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := BuildZstdDict(input, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(a, b) {
+				t.Fatal("dictionaries differ")
+			}
+		})
+	}
+}
+
+func TestBuildConcurrency(t *testing.T) {
+	input := testSamples(1000, 2)
+	for _, algo := range []Algorithm{AlgoHash, AlgoCover, AlgoFastCover} {
+		t.Run(algo.String(), func(t *testing.T) {
+			o := Options{MaxDictSize: 2048, HashBytes: 6, Algorithm: algo, Seed: 42, ZstdLevel: zstd.SpeedDefault}
+			var want []byte
+			for _, c := range []int{1, 3, 2000} {
+				o.Concurrency = c
+				got, err := BuildZstdDict(input, o)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want == nil {
+					want = got
+					continue
+				}
+				if !bytes.Equal(want, got) {
+					t.Fatalf("concurrency %d: output differs", c)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildZstdDictContextCancel(t *testing.T) {
+	input := testSamples(5000, 2)
+	for _, algo := range []Algorithm{AlgoHash, AlgoCover, AlgoFastCover} {
+		t.Run(algo.String(), func(t *testing.T) {
+			before := runtime.NumGoroutine()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			o := Options{MaxDictSize: 2048, HashBytes: 6, Algorithm: algo, Concurrency: 4, ZstdLevel: zstd.SpeedDefault}
+			o.Progress = func(done, total int) {
+				if done > 0 {
+					cancel()
+				}
+			}
+			_, err := BuildZstdDictContext(ctx, input, o)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("want context.Canceled, got %v", err)
+			}
+			// Goroutines may still be exiting after their last call.
+			deadline := time.Now().Add(5 * time.Second)
+			for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := runtime.NumGoroutine(); n > before {
+				t.Errorf("%d goroutines running, %d before build", n, before)
+			}
+		})
+	}
+}
+
+func TestBuildZstdDictWeighted(t *testing.T) {
+	lower := testSamples(500, 65)
+	upper := testSamples(500, 66)
+	for i, b := range upper {
+		upper[i] = bytes.ToUpper(b)
+	}
+	// Interleave the samples, so each part of the input has both.
+	var input [][]byte
+	for i := range lower {
+		input = append(input, lower[i], upper[i])
+	}
+	weights := func(wl, wu float64) []float64 {
+		w := make([]float64, len(input))
+		for i := range w {
+			w[i] = wl
+			if i%2 == 1 {
+				w[i] = wu
+			}
+		}
+		return w
+	}
+	// caseShare returns the share of letters in the content that are upper case.
+	caseShare := func(d []byte) float64 {
+		content, err := ToRawContent(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var l, u int
+		for _, c := range content {
+			switch {
+			case c >= 'a' && c <= 'z':
+				l++
+			case c >= 'A' && c <= 'Z':
+				u++
+			}
+		}
+		return float64(u) / float64(l+u)
+	}
+	o := Options{MaxDictSize: 512, HashBytes: 6, ZstdLevel: zstd.SpeedDefault}
+	for _, algo := range []Algorithm{AlgoHash, AlgoCover, AlgoFastCover} {
+		o.Algorithm = algo
+		lowDict, err := BuildZstdDictWeighted(input, weights(10, 1), o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upDict, err := BuildZstdDictWeighted(input, weights(1, 10), o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lo, up := caseShare(lowDict), caseShare(upDict); lo >= up {
+			t.Errorf("%v: upper case share %v with lower case weighted, %v with upper case weighted", algo, lo, up)
+		}
+		onlyLow, err := BuildZstdDictWeighted(input, weights(1, 0), o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The lower case samples only have the upper case letters of timestamps.
+		if share := caseShare(onlyLow); share > 0.05 {
+			t.Errorf("%v: upper case share %v with upper case samples weighted 0", algo, share)
+		}
+	}
+
+	if _, err := BuildZstdDictWeighted(input, weights(1, 1)[1:], o); err == nil {
+		t.Error("want error for weights length mismatch")
+	}
+	if _, err := BuildZstdDictWeighted(input, weights(1, -1), o); err == nil {
+		t.Error("want error for negative weight")
+	}
+	if _, err := BuildZstdDictWeighted(input, weights(0, 0), o); err == nil {
+		t.Error("want error for all weights 0")
+	}
+}
+
+func TestBuildConcurrencyMaxMemory(t *testing.T) {
+	input := testSamples(2000, 2)
+	for _, maxMem := range []int64{1 << 20, 256 << 10, 16 << 10, 8 << 10} {
+		o := Options{MaxDictSize: 2048, HashBytes: 6, Seed: 42, ZstdLevel: zstd.SpeedDefault, MaxMemoryBytes: maxMem}
+		var want []byte
+		for _, c := range []int{1, 4, 2000} {
+			o.Concurrency = c
+			got, err := BuildZstdDict(input, o)
+			if err != nil {
+				t.Fatalf("MaxMemoryBytes %d, concurrency %d: %v", maxMem, c, err)
+			}
+			if want == nil {
+				want = got
+				continue
+			}
+			if !bytes.Equal(want, got) {
+				t.Fatalf("MaxMemoryBytes %d, concurrency %d: output differs", maxMem, c)
+			}
+		}
+	}
+}
+
+func TestHashCountsPrune(t *testing.T) {
+	c := hashCounts{matches: make(map[uint32]uint32), offsets: make(map[uint32]int64)}
+	for i := uint32(0); i < 100; i++ {
+		c.matches[i] = 1
+		c.offsets[i] = int64(i)
+		c.total++
+	}
+	c.matches[50] = 10
+	c.total += 9
+	c.prune(20)
+	if len(c.matches) != 10 || len(c.offsets) != 10 {
+		t.Fatalf("got %d hashes, want 10", len(c.matches))
+	}
+	if c.matches[50] != 10 || c.total != 19 {
+		t.Errorf("got count %d, total %d", c.matches[50], c.total)
+	}
+	for i := uint32(0); i < 9; i++ {
+		if _, ok := c.matches[i]; !ok {
+			t.Errorf("hash %d with equal count not kept in hash order", i)
+		}
+	}
+	c.prune(1)
+	if len(c.matches) != 1 || c.matches[50] != 10 {
+		t.Errorf("want only the most frequent hash, got %v", c.matches)
+	}
+}
+
+func TestBuildZstdDictCompat(t *testing.T) {
+	input := testSamples(1000, 3)
+	const id = 0x12345678
+	d, err := BuildZstdDict(input, Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: id, ZstdDictCompat: true, ZstdLevel: zstd.SpeedDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.LittleEndian.Uint32(d[:4]); got != 0xEC30A437 {
+		t.Fatalf("magic: got %#x", got)
+	}
+	if got := binary.LittleEndian.Uint32(d[4:8]); got != id {
+		t.Fatalf("dict id: got %#x, want %#x", got, id)
+	}
+	if got, err := DictID(d); err != nil || got != id {
+		t.Fatalf("DictID: got %#x, %v, want %#x", got, err, id)
+	}
+	info, err := zstd.InspectDictionary(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID() != id {
+		t.Fatalf("inspected dict id: got %#x, want %#x", info.ID(), id)
+	}
+	if info.ContentSize() == 0 || info.ContentSize() > 2048 {
+		t.Fatalf("unexpected content size %d", info.ContentSize())
+	}
+
+	// Zstd v1.5.5 and earlier require the literal table to be able to encode symbol 255.
+	// Check by compressing symbol 255 with some other symbol, using only the dictionary table.
+	lits, _, err := huff0.ReadTable(d[8:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for c := 0; c < 255 && !found; c++ {
+		var enc huff0.Scratch
+		enc.TransferCTable(lits)
+		enc.Reuse = huff0.ReusePolicyMust
+		_, _, err := huff0.Compress1X(append(bytes.Repeat([]byte{byte(c)}, 1000), 255), &enc)
+		found = err == nil
+	}
+	if !found {
+		t.Fatal("literal table cannot encode symbol 255")
+	}
+
+	// Use the reference implementation if available.
+	zstdCmd, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Log("zstd command not found, skipping interop check")
+		return
+	}
+	dir := t.TempDir()
+	dictPath := filepath.Join(dir, "dict")
+	if err := os.WriteFile(dictPath, d, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderDict(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	cmd := exec.Command(zstdCmd, "-d", "-c", "-D", dictPath)
+	cmd.Stdin = bytes.NewReader(enc.EncodeAll(input[0], nil))
+	got, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, input[0]) {
+		t.Fatal("zstd command output mismatch")
+	}
+}
+
+func TestBuilderReuse(t *testing.T) {
+	for _, algo := range []Algorithm{AlgoHash, AlgoCover, AlgoFastCover} {
+		t.Run(algo.String(), func(t *testing.T) {
+			o := Options{MaxDictSize: 2048, HashBytes: 6, Algorithm: algo, Seed: 42, ZstdLevel: zstd.SpeedDefault}
+			b := NewBuilder(o)
+			for i, n := range []int{500, 1000, 200} {
+				input := testSamples(n, int64(i))
+				want, err := BuildZstdDict(input, o)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := b.Build(input)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(want, got) {
+					t.Fatalf("build %d: output differs", i)
+				}
+			}
+			input := testSamples(500, 0)
+			cold := testing.AllocsPerRun(2, func() { BuildZstdDict(input, o) })
+			warm := testing.AllocsPerRun(2, func() { b.Build(input) })
+			t.Logf("allocs cold: %v, warm: %v", cold, warm)
+			if warm > cold {
+				t.Errorf("reused builder did not reduce allocations (cold: %v, warm: %v)", cold, warm)
+			}
+
+			// Building the entropy tables allocates for each build,
+			// so measure selecting the content without them.
+			o.RawContentOnly = true
+			b = NewBuilder(o)
+			b.Build(input)
+			coldAllocs := testing.AllocsPerRun(2, func() { BuildZstdDict(input, o) })
+			warmAllocs := testing.AllocsPerRun(2, func() { b.Build(input) })
+			coldBytes := allocBytesPerRun(2, func() { BuildZstdDict(input, o) })
+			warmBytes := allocBytesPerRun(2, func() { b.Build(input) })
+			t.Logf("content allocs cold: %v (%d bytes), warm: %v (%d bytes)", coldAllocs, coldBytes, warmAllocs, warmBytes)
+			if warmAllocs > coldAllocs || warmBytes*4 > coldBytes {
+				t.Errorf("reused builder did not reduce allocations (cold: %v, %d bytes, warm: %v, %d bytes)", coldAllocs, coldBytes, warmAllocs, warmBytes)
+			}
+		})
+	}
+}
+
+// allocBytesPerRun returns the average number of bytes allocated by f over runs calls,
+// after a warm-up call.
+func allocBytesPerRun(runs int, f func()) uint64 {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	f()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < runs; i++ {
+		f()
+	}
+	runtime.ReadMemStats(&after)
+	return (after.TotalAlloc - before.TotalAlloc) / uint64(runs)
+}
+
+func TestBuildZstdDictSizes(t *testing.T) {
+	input := testSamples(1000, 4)
+	sizes := []int{512, 4096, 1024}
+	for _, algo := range []Algorithm{AlgoHash, AlgoCover, AlgoFastCover} {
+		t.Run(algo.String(), func(t *testing.T) {
+			o := Options{HashBytes: 6, Algorithm: algo, Seed: 42, ZstdLevel: zstd.SpeedDefault}
+			dicts, err := BuildZstdDictSizes(input, sizes, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, size := range sizes {
+				info, err := zstd.InspectDictionary(dicts[size])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.ContentSize() > size {
+					t.Errorf("size %d: content size is %d", size, info.ContentSize())
+				}
+			}
+			o.MaxDictSize = 4096
+			want, err := BuildZstdDict(input, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(want, dicts[4096]) {
+				t.Error("largest dictionary differs from BuildZstdDict")
+			}
+		})
+	}
+}
+
+func TestRawContentOnly(t *testing.T) {
+	input := testSamples(1000, 5)
+	o := Options{MaxDictSize: 2048, HashBytes: 6, Seed: 42, ZstdLevel: zstd.SpeedDefault}
+	full, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.RawContentOnly = true
+	raw, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := zstd.InspectDictionary(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(info.Content(), raw) {
+		t.Fatal("raw content differs from content of full dictionary")
+	}
+	if got, err := DictID(raw); err != nil || got != 0 {
+		t.Fatalf("DictID of raw content: got %d, %v", got, err)
+	}
+
+	const id = 1234
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderDictRaw(id, raw), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderDictRaw(id, raw), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	fullEnc, err := zstd.NewWriter(nil, zstd.WithEncoderDict(full), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fullEnc.Close()
+	var rawSize, fullSize, plainSize int
+	for _, in := range input[:100] {
+		compressed := enc.EncodeAll(in, nil)
+		var fh zstd.Header
+		if err := fh.Decode(compressed); err != nil {
+			t.Fatal(err)
+		}
+		if fh.DictionaryID != id {
+			t.Fatalf("frame dictionary ID %d, want %d", fh.DictionaryID, id)
+		}
+		got, err := dec.DecodeAll(compressed, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, in) {
+			t.Fatal("output mismatch")
+		}
+		rawSize += len(compressed)
+		fullSize += len(fullEnc.EncodeAll(in, nil))
+		plainSize += len(in)
+	}
+	t.Logf("input: %d, raw dict: %d, full dict: %d", plainSize, rawSize, fullSize)
+	if rawSize >= plainSize {
+		t.Error("raw dictionary did not compress")
+	}
+}
+
+func TestComputeRepeatOffsets(t *testing.T) {
+	input := testSamples(1000, 6)
+	o := Options{MaxDictSize: 2048, HashBytes: 6, Algorithm: AlgoCover, ZstdDictID: 1, ZstdLevel: zstd.SpeedDefault, ComputeRepeatOffsets: true}
+	d, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := zstd.InspectDictionary(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Building with the computed offsets should keep them.
+	d2, err := zstd.BuildDict(zstd.BuildDictOptions{ID: 1, Contents: input, History: info.Content(), Offsets: info.Offsets(), Level: zstd.SpeedDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info2, err := zstd.InspectDictionary(d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Offsets() != info2.Offsets() {
+		t.Errorf("offsets not stable: got %v, rebuilt %v", info.Offsets(), info2.Offsets())
+	}
+	if !bytes.Equal(d, d2) {
+		t.Error("dictionary differs from one built with the computed offsets")
+	}
+}
+
+func TestBuildFlateDict(t *testing.T) {
+	input := testSamples(1000, 7)
+	d, err := BuildFlateDict(input, Options{MaxDictSize: 64 << 10, HashBytes: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d) > 32<<10 {
+		t.Fatalf("dictionary is %d bytes", len(d))
+	}
+	var withDict, without int
+	for _, in := range testSamples(100, 8) {
+		var buf bytes.Buffer
+		fw, err := flate.NewWriterDict(&buf, flate.BestCompression, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(in)
+		fw.Close()
+		withDict += buf.Len()
+		got, err := io.ReadAll(flate.NewReaderDict(&buf, d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, in) {
+			t.Fatal("output mismatch")
+		}
+
+		buf.Reset()
+		fw, _ = flate.NewWriter(&buf, flate.BestCompression)
+		fw.Write(in)
+		fw.Close()
+		without += buf.Len()
+	}
+	t.Logf("with dictionary: %d, without: %d", withDict, without)
+	if withDict >= without {
+		t.Error("dictionary did not improve compression")
+	}
+}
+
+func TestMakeS2Dict(t *testing.T) {
+	input := testSamples(1000, 9)
+	d, err := MakeS2Dict(input, Options{MaxDictSize: 4096, HashBytes: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var withDict, without int
+	for _, in := range testSamples(100, 10) {
+		for _, enc := range []func(dst, src []byte) []byte{d.Encode, d.EncodeBetter, d.EncodeBest} {
+			compressed := enc(nil, in)
+			got, err := d.Decode(nil, compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, in) {
+				t.Fatal("output mismatch")
+			}
+		}
+		withDict += len(d.Encode(nil, in))
+		without += len(s2.Encode(nil, in))
+	}
+	t.Logf("with dictionary: %d, without: %d", withDict, without)
+	if withDict >= without {
+		t.Error("dictionary did not improve compression")
+	}
+	if _, err := MakeS2Dict(input, Options{MaxDictSize: s2.MaxDictSize + 1, HashBytes: 6}); err == nil {
+		t.Error("want error for too large MaxDictSize")
+	}
+}
+
+func TestMaxEntropyTableBytes(t *testing.T) {
+	input := testSamples(1000, 11)
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1, ZstdLevel: zstd.SpeedDefault}
+	d, stats, err := BuildZstdDictWithStats(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ContentSize+stats.TablesSize != len(d) {
+		t.Fatalf("content %d + tables %d != %d", stats.ContentSize, stats.TablesSize, len(d))
+	}
+	if stats.EntropyTablesSize <= 0 || stats.EntropyTablesSize != stats.TablesSize-20 {
+		t.Fatalf("unexpected entropy tables size %d, tables size %d", stats.EntropyTablesSize, stats.TablesSize)
+	}
+
+	o.MaxEntropyTableBytes = stats.EntropyTablesSize
+	d2, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d, d2) {
+		t.Error("dictionary changed with tables within limit")
+	}
+
+	o.MaxEntropyTableBytes = stats.EntropyTablesSize - 1
+	raw, stats, err := BuildZstdDictWithStats(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != stats.ContentSize || stats.TablesSize != 0 || stats.EntropyTablesSize != 0 || !stats.EntropyTablesOmitted {
+		t.Errorf("tables not omitted: size %d, stats %+v", len(raw), stats)
+	}
+	if !bytes.Equal(raw, d[len(d)-len(raw):]) {
+		t.Error("content differs")
+	}
+}
+
+func TestBuildZstdDictFromOffsets(t *testing.T) {
+	input := testSamples(1000, 12)
+	var buf []byte
+	var offsets []int
+	for _, b := range input {
+		offsets = append(offsets, len(buf))
+		buf = append(buf, b...)
+	}
+	o := Options{MaxDictSize: 2048, HashBytes: 6, Seed: 1, ZstdLevel: zstd.SpeedDefault}
+	want, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := BuildZstdDictFromOffsets(buf, offsets, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("dictionary differs from one built from slices")
+	}
+	for _, offsets := range [][]int{{-1}, {len(buf) + 1}, {10, 5}} {
+		if _, err := BuildZstdDictFromOffsets(buf, offsets, o); err == nil {
+			t.Errorf("offsets %v: want error", offsets)
+		}
+	}
+}
+
+func TestAutoHashBytes(t *testing.T) {
+	input := testSamples(1000, 13)
+	o := Options{MaxDictSize: 2048, AutoHashBytes: true, Seed: 1, ZstdDictID: 1, ZstdLevel: zstd.SpeedDefault}
+	d, stats, err := BuildZstdDictWithStats(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("selected HashBytes:", stats.HashBytes)
+	if stats.HashBytes < 4 || stats.HashBytes > 8 {
+		t.Fatalf("unexpected HashBytes %d", stats.HashBytes)
+	}
+	o.AutoHashBytes = false
+	o.HashBytes = stats.HashBytes
+	want, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d, want) {
+		t.Error("dictionary differs from one built with the selected HashBytes")
+	}
+	o.AutoHashBytes = true
+	o.HashBytes = 0
+	o.Concurrency = 1
+	_, stats2, err := BuildZstdDictWithStats(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats2.HashBytes != stats.HashBytes {
+		t.Errorf("Concurrency changed selected HashBytes from %d to %d", stats.HashBytes, stats2.HashBytes)
+	}
+}
+
+func TestWriteDictFile(t *testing.T) {
+	d, err := BuildZstdDict(testSamples(500, 75), Options{MaxDictSize: 2048, HashBytes: 6, ZstdLevel: zstd.SpeedDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.dict")
+	if err := os.WriteFile(path, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteDictFile(path, d); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadDictFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, d) {
+		t.Error("read dictionary differs")
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0o644 {
+			t.Errorf("permissions %v, want 0644", perm)
+		}
+	}
+
+	// A failed write leaves neither a partial file nor a temporary file.
+	target := filepath.Join(dir, "target")
+	if err := os.MkdirAll(filepath.Join(target, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteDictFile(target, d); err == nil {
+		t.Fatal("want error writing over a directory")
+	}
+	if err := WriteDictFile(filepath.Join(dir, "missing", "test.dict"), d); err == nil {
+		t.Fatal("want error for missing directory")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "test.dict" && e.Name() != "target" {
+			t.Errorf("unexpected file %q left", e.Name())
+		}
+	}
+	if fi, err := os.Stat(target); err != nil || !fi.IsDir() {
+		t.Errorf("directory replaced: %v", err)
+	}
+}
+
+func TestDictFileChecksummed(t *testing.T) {
+	d, err := BuildZstdDict(testSamples(1000, 14), Options{MaxDictSize: 2048, HashBytes: 6, ZstdLevel: zstd.SpeedDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "dict.bin")
+	if err := WriteDictFileChecksummed(path, d); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadDictFileChecksummed(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, d) {
+		t.Fatal("dictionary mismatch")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := map[string][]byte{
+		"flipped":   append(append([]byte(nil), b[:len(b)-1]...), b[len(b)-1]^1),
+		"truncated": b[:len(b)-1],
+		"header":    b[:8],
+		"plain":     d,
+	}
+	for name, c := range corrupt {
+		if err := os.WriteFile(path, c, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadDictFileChecksummed(path); !errors.Is(err, ErrDictCorrupt) {
+			t.Errorf("%s: got error %v, want %v", name, err, ErrDictCorrupt)
+		}
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	input := testSamples(1000, 15)
+	d, err := BuildZstdDict(input, Options{MaxDictSize: 2048, HashBytes: 6, ZstdLevel: zstd.SpeedDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, dict := range map[string][]byte{"zstd": d, "raw": d[len(d)-1024:]} {
+		res, err := Benchmark(dict, input[:100], zstd.SpeedDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%s: %+v", name, res)
+		if res.Ratio <= 1 || res.EncodeMBPerSec <= 0 || res.DecodeMBPerSec <= 0 {
+			t.Errorf("%s: unexpected result %+v", name, res)
+		}
+	}
+}
+
+func TestBuildZstdDictsByClass(t *testing.T) {
+	a := testSamples(500, 16)
+	var input [][]byte
+	for i, b := range a {
+		input = append(input, b)
+		if i%2 == 0 {
+			input = append(input, []byte(fmt.Sprintf("<item><id>%d</id><value>%s</value></item>", i, b[:20])))
+		}
+	}
+	classOf := func(i int) string {
+		if input[i][0] == '<' {
+			return "xml"
+		}
+		return "json"
+	}
+	o := Options{MaxDictSize: 1024, HashBytes: 6, ZstdLevel: zstd.SpeedDefault}
+	dicts, err := BuildZstdDictsByClass(input, classOf, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dicts) != 2 {
+		t.Fatalf("got %d dictionaries, want 2", len(dicts))
+	}
+	for class, d := range dicts {
+		id, err := DictID(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != classDictID(class) {
+			t.Errorf("class %s: got ID %d, want %d", class, id, classDictID(class))
+		}
+	}
+	if !bytes.Contains(dicts["xml"], []byte("<item>")) || bytes.Contains(dicts["json"], []byte("<item>")) {
+		t.Error("dictionary content does not match class")
+	}
+}
+
+func TestTrainer(t *testing.T) {
+	input := testSamples(1000, 13)
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	tr := NewTrainer(o)
+	if _, err := tr.Finish(); !errors.Is(err, ErrNoSamples) {
+		t.Fatalf("want ErrNoSamples, got %v", err)
+	}
+	buf := make([]byte, 0, 1024)
+	for _, b := range input[:500] {
+		// Reuse the buffer to check samples are copied.
+		buf = append(buf[:0], b...)
+		tr.Add(buf)
+	}
+	for i := range buf {
+		buf[i] = 0
+	}
+	for n, end := range []int{500, 1000} {
+		if n > 0 {
+			for _, b := range input[500:end] {
+				tr.Add(b)
+			}
+		}
+		got, err := tr.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := BuildZstdDict(input[:end], o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%d samples: trainer dictionary differs from BuildZstdDict", end)
+		}
+	}
+
+	// Options that select samples count all samples in Finish.
+	o.Dedup = true
+	tr = NewTrainer(o)
+	for _, b := range input {
+		tr.Add(b)
+		tr.Add(b)
+	}
+	got, err := tr.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("dedup: trainer dictionary differs from BuildZstdDict")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	unique := testSamples(300, 9)
+	var input [][]byte
+	for i, b := range unique {
+		input = append(input, b)
+		if i%3 == 0 {
+			// Copy, so duplicates are not found by comparing pointers.
+			input = append(input, append([]byte(nil), b...), append([]byte(nil), b...))
+		}
+	}
+	var buf bytes.Buffer
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault, Dedup: true, Output: &buf}
+	got, stats, err := BuildZstdDictWithStats(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Duplicates != 200 || stats.Samples != len(unique) {
+		t.Errorf("got %d duplicates removed, %d samples used; want 200 and %d", stats.Duplicates, stats.Samples, len(unique))
+	}
+	if !strings.Contains(buf.String(), "Removed 200 duplicate samples\n") {
+		t.Errorf("duplicates not reported in output: %q", buf.String())
+	}
+	o.Output = nil
+	want, err := BuildZstdDict(unique, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("dictionary differs from building without the duplicates")
+	}
+
+	// The dictionary does not depend on the order of the samples.
+	rng := rand.New(rand.NewSource(9))
+	for i := 0; i < 3; i++ {
+		rng.Shuffle(len(input), func(i, j int) { input[i], input[j] = input[j], input[i] })
+		got, err := BuildZstdDict(input, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatal("dictionary depends on sample order")
+		}
+	}
+}
+
+func TestDedupWeights(t *testing.T) {
+	a, b, c := []byte("sample a"), []byte("sample b"), []byte("sample c")
+	input := [][]byte{a, b, []byte("sample a"), c, []byte("sample a"), []byte("sample c")}
+	gotIn, gotW := dedupSamples(input, []float64{1, 2, 3, 4, 5, 6})
+	if !reflect.DeepEqual(gotIn, [][]byte{a, b, c}) || !reflect.DeepEqual(gotW, []float64{9, 2, 10}) {
+		t.Errorf("got samples %q with weights %v; want %q with weights [9 2 10]", gotIn, gotW, [][]byte{a, b, c})
+	}
+	if _, w := dedupSamples(input, nil); w != nil {
+		t.Errorf("got weights %v without weights", w)
+	}
+
+	// Building with duplicates folded into the weights gives the same dictionary
+	// as building with the summed weights.
+	unique := testSamples(300, 10)
+	var dupes [][]byte
+	var dupeW []float64
+	sumW := make([]float64, len(unique))
+	for i, b := range unique {
+		n := 1 + i%4
+		for j := 0; j < n; j++ {
+			dupes = append(dupes, append([]byte(nil), b...))
+			dupeW = append(dupeW, 1)
+		}
+		sumW[i] = float64(n)
+	}
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault, Dedup: true}
+	got, err := BuildZstdDictWeighted(dupes, dupeW, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := BuildZstdDictWeighted(unique, sumW, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("weights of duplicates not folded into the kept sample")
+	}
+}
+
+func TestTrainerMaxMemory(t *testing.T) {
+	input := testSamples(2000, 14)
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault, MaxMemoryBytes: 1000 * hashCountBytes}
+	tr := NewTrainer(o)
+	for _, b := range input {
+		tr.Add(b)
+		if n := len(tr.counts.matches); n > 1000 {
+			t.Fatalf("%d hashes counted, limit is 1000", n)
+		}
+	}
+	dict, err := tr.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EstimateRatio(dict, input[:100], zstd.SpeedDefault); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrainerInvalidOptions(t *testing.T) {
+	// A custom hash function reads HashBytes bytes, beyond the end of the short sample.
+	input := append(testSamples(100, 51), []byte("8 bytes."))
+	hashFunc := func(b []byte) uint64 { return uint64(len(b)) }
+	for _, o := range []Options{
+		{MaxDictSize: 1024, HashBytes: 0},
+		{MaxDictSize: 1024, HashBytes: 2},
+		{MaxDictSize: 1024, HashBytes: 9},
+		{MaxDictSize: 1024, HashBytes: 9, HashFunc: hashFunc},
+		{MaxDictSize: 1024, HashBytes: 100, HashFunc: hashFunc},
+		{MaxDictSize: 4, HashBytes: 6},
+	} {
+		want := o.validate()
+		if want == nil {
+			t.Fatalf("HashBytes %d, MaxDictSize %d: options not invalid", o.HashBytes, o.MaxDictSize)
+		}
+		// Adding samples must not use the invalid options.
+		tr := NewTrainer(o)
+		for _, b := range input {
+			tr.Add(b)
+		}
+		if _, err := tr.Finish(); err == nil || err.Error() != want.Error() {
+			t.Errorf("HashBytes %d, MaxDictSize %d: got error %v, want %v", o.HashBytes, o.MaxDictSize, err, want)
+		}
+		if _, err := BuildZstdDict(input, o); err == nil || err.Error() != want.Error() {
+			t.Errorf("HashBytes %d, MaxDictSize %d: BuildZstdDict returned %v, want %v", o.HashBytes, o.MaxDictSize, err, want)
+		}
+	}
+}
+
+func TestInspectDict(t *testing.T) {
+	input := testSamples(500, 15)
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	framed, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := InspectDict(framed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Raw || !info.HasEntropyTables || info.ID != 1234 {
+		t.Fatalf("framed dictionary: got %+v", info)
+	}
+	o.ZstdDictID = 0
+	o.RawContentOnly = true
+	raw, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = InspectDict(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Raw || info.HasEntropyTables || info.ID != 0 || info.ContentSize != len(raw) {
+		t.Fatalf("raw dictionary: got %+v", info)
+	}
+	for _, b := range [][]byte{nil, zstdDictMagic[:3]} {
+		if _, err := InspectDict(b); err == nil {
+			t.Fatalf("%d bytes: want error", len(b))
+		}
+	}
+	if _, err := InspectDict(framed[:20]); err == nil {
+		t.Fatal("truncated framed dictionary: want error")
+	}
+}
+
+func TestFlateDictAdler32(t *testing.T) {
+	input := testSamples(500, 16)
+	dict, err := BuildFlateDict(input, Options{MaxDictSize: 4096, HashBytes: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevelDict(&buf, zlib.DefaultCompression, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(input[0])
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The zlib header is followed by the dictionary checksum.
+	want := binary.BigEndian.Uint32(buf.Bytes()[2:6])
+	if got := FlateDictAdler32(dict); got != want {
+		t.Fatalf("got %08x, zlib wrote %08x", got, want)
+	}
+	r, err := zlib.NewReaderDict(&buf, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, input[0]) {
+		t.Fatal("output mismatch")
+	}
+}
+
+func TestRecencyDecay(t *testing.T) {
+	// Old samples are JSON, recent samples use a different format.
+	old := testSamples(1000, 17)
+	rng := rand.New(rand.NewSource(17))
+	recent := make([][]byte, 1000)
+	for i := range recent {
+		recent[i] = []byte(fmt.Sprintf("<event level=\"info\" source=\"gateway-%d\" latency_ms=\"%d\"><message>request completed for tenant %d</message></event>",
+			rng.Intn(16), rng.Intn(500), rng.Intn(100000)))
+	}
+	input := append(append([][]byte{}, old...), recent...)
+	o := Options{MaxDictSize: 1024, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	uniform, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.RecencyDecay = 5
+	decayed, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uniformRatio, err := EstimateRatio(uniform, recent[:200], zstd.SpeedDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decayedRatio, err := EstimateRatio(decayed, recent[:200], zstd.SpeedDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("recent samples ratio: uniform %.3f, decayed %.3f", uniformRatio, decayedRatio)
+	if decayedRatio >= uniformRatio {
+		t.Fatalf("decay did not favor recent samples: %.3f >= %.3f", decayedRatio, uniformRatio)
+	}
+
+	o.RecencyDecay = -1
+	if _, err := BuildZstdDict(input, o); err == nil {
+		t.Fatal("want error for negative decay")
+	}
+}
+
+func TestOutlierSamples(t *testing.T) {
+	input := testSamples(500, 18)
+	dict, err := BuildZstdDict(input, Options{MaxDictSize: 2048, HashBytes: 6, ZstdLevel: zstd.SpeedDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Insert random samples, which the dictionary cannot help.
+	rng := rand.New(rand.NewSource(18))
+	samples := append([][]byte{}, testSamples(100, 19)...)
+	outliers := []int{17, 42, 99}
+	for _, i := range outliers {
+		samples[i] = make([]byte, len(samples[i]))
+		rng.Read(samples[i])
+	}
+	samples = append(samples, nil)
+	got, err := OutlierSamples(dict, samples, len(outliers), zstd.SpeedDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(outliers) {
+		t.Fatalf("got %d outliers, want %d", len(got), len(outliers))
+	}
+	found := make(map[int]bool)
+	for _, i := range got {
+		found[i] = true
+	}
+	for _, i := range outliers {
+		if !found[i] {
+			t.Errorf("sample %d not reported, got %v", i, got)
+		}
+	}
+	got, err = OutlierSamples(dict, samples, 1000, zstd.SpeedDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(samples)-1 {
+		t.Fatalf("got %d samples, want all %d non-empty samples", len(got), len(samples)-1)
+	}
+	if _, err := OutlierSamples(dict, samples, 0, zstd.SpeedDefault); err == nil {
+		t.Fatal("want error for topN 0")
+	}
+}
+
+func TestExcludeSequences(t *testing.T) {
+	input := testSamples(1000, 20)
+	exclude := [][]byte{[]byte("@example.com"), []byte(`"created":"2023-01-`)}
+	for _, algo := range []Algorithm{AlgoHash, AlgoCover, AlgoFastCover} {
+		t.Run(algo.String(), func(t *testing.T) {
+			o := Options{MaxDictSize: 2048, HashBytes: 6, Algorithm: algo, ZstdLevel: zstd.SpeedDefault, RawContentOnly: true}
+			dict, err := BuildZstdDict(input, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !containsAny(dict, exclude) {
+				t.Fatal("test sequences not in dictionary without exclusion")
+			}
+			o.ExcludeSequences = exclude
+			dict, stats, err := BuildZstdDictWithStats(input, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Excluded == 0 {
+				t.Error("no candidates excluded")
+			}
+			for _, seq := range exclude {
+				if n := bytes.Count(dict, seq); n > 1 {
+					t.Errorf("%q found %d times in dictionary", seq, n)
+				}
+			}
+		})
+	}
+	_, err := BuildZstdDict(input, Options{MaxDictSize: 2048, HashBytes: 6, ExcludeSequences: [][]byte{{}}})
+	if err == nil {
+		t.Fatal("want error for empty sequence")
+	}
+}
+
+func TestRawContentConversion(t *testing.T) {
+	input := testSamples(1000, 21)
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	full, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := zstd.InspectDictionary(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ToRawContent(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, d.Content()) {
+		t.Fatal("content mismatch")
+	}
+	if got, err := ToRawContent(content); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("raw content not returned as is: %v", err)
+	}
+
+	o.ZstdDictID = 5678
+	rebuilt, err := FromRawContent(content, input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tables must not compress worse than the content alone with the same ID.
+	eval := testSamples(300, 22)
+	if got, want := testCompressedSize(t, eval, zstd.WithEncoderDict(rebuilt)), testCompressedSize(t, eval, zstd.WithEncoderDictRaw(5678, content)); got > want {
+		t.Errorf("rebuilt dictionary compresses to %d bytes, raw content to %d", got, want)
+	}
+	info, err := InspectDict(rebuilt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != 5678 || !info.HasEntropyTables {
+		t.Fatalf("got %+v", info)
+	}
+	if got, err := ToRawContent(rebuilt); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("rebuilt dictionary content mismatch: %v", err)
+	}
+	if _, err := EstimateRatio(rebuilt, testSamples(100, 22), zstd.SpeedDefault); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FromRawContent(full, input, o); err == nil {
+		t.Fatal("want error for framed dictionary")
+	}
+	if _, err := FromRawContent(content[:7], input, o); err == nil {
+		t.Fatal("want error for short content")
+	}
+	if _, err := FromRawContent(content, nil, o); !errors.Is(err, ErrNoSamples) {
+		t.Fatalf("want ErrNoSamples, got %v", err)
+	}
+}
+
+// testCompressedSize returns the combined size of samples compressed with the encoder dictionary option.
+func testCompressedSize(t *testing.T, samples [][]byte, dict zstd.EOption) int {
+	t.Helper()
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderConcurrency(1), dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	n := 0
+	for _, b := range samples {
+		n += len(enc.EncodeAll(b, nil))
+	}
+	return n
+}
+
+func TestRefineZstdDict(t *testing.T) {
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	existing, err := BuildZstdDict(testSamples(1000, 72), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upper := func(samples [][]byte) [][]byte {
+		for i, b := range samples {
+			samples[i] = bytes.ToUpper(b)
+		}
+		return samples
+	}
+	for _, tc := range []struct {
+		name        string
+		input, eval [][]byte
+	}{
+		{name: "similar", input: testSamples(1000, 73), eval: testSamples(300, 74)},
+		{name: "changed", input: upper(testSamples(1000, 73)), eval: upper(testSamples(300, 74))},
+	} {
+		refined, err := RefineZstdDict(existing, tc.input, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := zstd.InspectDictionary(refined)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ID() != 1234 {
+			t.Errorf("%s: ID %d, want ZstdDictID 1234", tc.name, info.ID())
+		}
+		before, err := EstimateRatio(existing, tc.eval, zstd.SpeedDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := EstimateRatio(refined, tc.eval, zstd.SpeedDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after > before {
+			t.Errorf("%s: ratio %v after refining, %v before", tc.name, after, before)
+		}
+	}
+	o.ZstdDictID = 0
+	o.Seed = 1
+	refined, err := RefineZstdDict(existing, testSamples(1000, 73), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := zstd.InspectDictionary(refined); err != nil || info.ID() == 1234 {
+		t.Errorf("without ZstdDictID, want a new ID: %v", err)
+	}
+}
+
+func TestMergeZstdDicts(t *testing.T) {
+	a := testSamples(500, 60)
+	b := testSamples(500, 61)
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdLevel: zstd.SpeedDefault}
+	da, err := BuildZstdDict(a, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := BuildZstdDict(b, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ToRawContent(da)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, err := ToRawContent(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := append(append([][]byte(nil), a...), b...)
+	eval := append(testSamples(150, 62), testSamples(150, 63)...)
+
+	// Content that fits is concatenated, with the first dictionary last.
+	o.MaxDictSize = len(ca) + len(cb)
+	o.ZstdDictID = 4321
+	merged, err := MergeZstdDicts([][]byte{da, db}, samples, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := zstd.InspectDictionary(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContent := append(append([]byte(nil), cb...), ca...)
+	if info.ID() != 4321 || !bytes.Equal(info.Content(), wantContent) {
+		t.Fatalf("got ID %d, content %d bytes, want %d bytes", info.ID(), len(info.Content()), len(wantContent))
+	}
+	if got, want := testCompressedSize(t, eval, zstd.WithEncoderDict(merged)), testCompressedSize(t, eval, zstd.WithEncoderDictRaw(4321, wantContent)); got > want {
+		t.Errorf("merged dictionary compresses to %d bytes, raw content to %d", got, want)
+	}
+
+	// Content that does not fit is selected from the dictionaries.
+	o.MaxDictSize = 2048
+	merged, err = MergeZstdDicts([][]byte{da, db}, samples, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = zstd.InspectDictionary(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentSize() > 2048 {
+		t.Errorf("content size %d exceeds MaxDictSize", info.ContentSize())
+	}
+
+	if _, err := MergeZstdDicts([][]byte{da, db}, nil, o); !errors.Is(err, ErrNoSamples) {
+		t.Errorf("want ErrNoSamples, got %v", err)
+	}
+	if _, err := MergeZstdDicts(nil, samples, o); err == nil {
+		t.Error("want error for no dictionaries")
+	}
+}
+
+func TestSmallFramesWithDict(t *testing.T) {
+	input := testSamples(1000, 23)
+	dict, err := BuildZstdDict(input, Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dict))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	for _, tc := range []struct {
+		name string
+		opts []zstd.EOption
+	}{
+		{name: "nocrc", opts: []zstd.EOption{zstd.WithEncoderCRC(false)}},
+		{name: "padded", opts: []zstd.EOption{zstd.WithEncoderCRC(false), zstd.WithEncoderPadding(64)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			enc, err := zstd.NewWriter(nil, append(tc.opts, zstd.WithEncoderDict(dict), zstd.WithEncoderLevel(zstd.SpeedDefault))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer enc.Close()
+			for _, b := range testSamples(100, 24) {
+				frame := enc.EncodeAll(b, nil)
+				id, ok, err := zstd.GetDictID(frame)
+				if err != nil || !ok || id != 1234 {
+					t.Fatalf("got dictionary ID %d, %v, %v", id, ok, err)
+				}
+				got, err := dec.DecodeAll(frame, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, b) {
+					t.Fatal("output mismatch")
+				}
+			}
+		})
+	}
+}
+
+func TestMinSegmentFrequency(t *testing.T) {
+	// Few samples, where pairs of samples share content not seen elsewhere.
+	rng := rand.New(rand.NewSource(25))
+	input := testSamples(40, 25)
+	for i := range input {
+		if i%2 == 1 {
+			continue
+		}
+		pair := make([]byte, 200)
+		for j := range pair {
+			pair[j] = 'a' + byte(rng.Intn(26))
+		}
+		input[i] = append(input[i], pair...)
+		input[i+1] = append(input[i+1], pair...)
+	}
+	for _, algo := range []Algorithm{AlgoHash, AlgoCover, AlgoFastCover} {
+		t.Run(algo.String(), func(t *testing.T) {
+			o := Options{MaxDictSize: 4096, HashBytes: 6, Algorithm: algo, SegmentSize: 16, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+			_, segs, err := BuildZstdDictDebug(input, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rare := 0
+			for _, s := range segs {
+				if s.Frequency < 3 {
+					rare++
+				}
+			}
+			if rare == 0 {
+				t.Fatal("no rare segments without MinSegmentFrequency")
+			}
+			o.MinSegmentFrequency = 3
+			_, stats, err := BuildZstdDictWithStats(input, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Infrequent == 0 {
+				t.Error("no candidates skipped")
+			}
+			_, segs, err = BuildZstdDictDebug(input, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range segs {
+				if s.Frequency < 3 {
+					t.Errorf("segment %q in %d samples", s.Content, s.Frequency)
+				}
+			}
+		})
+	}
+	_, err := BuildZstdDict(input, Options{MaxDictSize: 4096, HashBytes: 6, MinSegmentFrequency: len(input) + 1})
+	if err == nil || !strings.Contains(err.Error(), "no content selected") {
+		t.Fatalf("want no content error, got %v", err)
+	}
+}
+
+func TestLegacyDict(t *testing.T) {
+	for _, magic := range []uint32{0xEC30A435, 0xEC30A436} {
+		dict := binary.LittleEndian.AppendUint32(nil, magic)
+		dict = append(dict, bytes.Repeat([]byte("legacy dictionary content"), 10)...)
+		if _, err := InspectDict(dict); !errors.Is(err, ErrLegacyDict) {
+			t.Errorf("%08x: InspectDict: want ErrLegacyDict, got %v", magic, err)
+		}
+		if _, err := DictID(dict); !errors.Is(err, ErrLegacyDict) {
+			t.Errorf("%08x: DictID: want ErrLegacyDict, got %v", magic, err)
+		}
+		path := filepath.Join(t.TempDir(), "legacy.dict")
+		if err := os.WriteFile(path, dict, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadDictFile(path); !errors.Is(err, ErrLegacyDict) {
+			t.Errorf("%08x: ReadDictFile: want ErrLegacyDict, got %v", magic, err)
+		}
+	}
+}
+
+func TestNormalizeBySize(t *testing.T) {
+	// A few large samples of one kind, and many small samples of another.
+	rng := rand.New(rand.NewSource(26))
+	var input [][]byte
+	for i := 0; i < 5; i++ {
+		var b []byte
+		for len(b) < 200<<10 {
+			b = append(b, fmt.Sprintf("<event level=\"info\" source=\"gateway-%d\" latency_ms=\"%d\"><message>request completed for tenant %d</message></event>\n",
+				rng.Intn(16), rng.Intn(500), rng.Intn(100000))...)
+		}
+		input = append(input, b)
+	}
+	input = append(input, testSamples(500, 26)...)
+	o := Options{MaxDictSize: 1024, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	plain, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.NormalizeBySize = true
+	normalized, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test := testSamples(200, 27)
+	plainRatio, err := EstimateRatio(plain, test, zstd.SpeedDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	normRatio, err := EstimateRatio(normalized, test, zstd.SpeedDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("small samples ratio: plain %.3f, normalized %.3f", plainRatio, normRatio)
+	if normRatio >= plainRatio {
+		t.Fatalf("normalizing did not favor small samples: %.3f >= %.3f", normRatio, plainRatio)
+	}
+}
+
+func TestDriftScore(t *testing.T) {
+	input := testSamples(1000, 28)
+	dict, stats, err := BuildZstdDictWithStats(input, Options{MaxDictSize: 2048, HashBytes: 6, ZstdLevel: zstd.SpeedDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, err := DriftScore(dict, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(same-stats.Coverage) > 1e-9 {
+		t.Errorf("score %v of training samples differs from coverage %v", same, stats.Coverage)
+	}
+	fresh, err := DriftScore(dict, testSamples(200, 29))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(28))
+	drifted := make([][]byte, 200)
+	for i := range drifted {
+		drifted[i] = []byte(fmt.Sprintf("<event level=\"info\" source=\"gateway-%d\" latency_ms=\"%d\"><message>request completed for tenant %d</message></event>",
+			rng.Intn(16), rng.Intn(500), rng.Intn(100000)))
+	}
+	changed, err := DriftScore(dict, drifted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("training %.3f, fresh %.3f, drifted %.3f", same, fresh, changed)
+	if fresh < same*0.9 || changed > fresh/2 {
+		t.Fatal("unexpected scores")
+	}
+	if _, err := DriftScore(dict, nil); !errors.Is(err, ErrNoSamples) {
+		t.Fatalf("want ErrNoSamples, got %v", err)
+	}
+}
+
+func TestBuildZstdDictFromTar(t *testing.T) {
+	input := testSamples(500, 30)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "samples/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range input {
+		if err := tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("samples/%d.json", i), Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(b))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if i%100 == 0 {
+			if err := tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("samples/link%d", i), Typeflag: tar.TypeSymlink, Linkname: fmt.Sprintf("%d.json", i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	got, err := BuildZstdDictFromTar(bytes.NewReader(buf.Bytes()), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("dictionary differs from BuildZstdDict")
+	}
+	if _, err := BuildZstdDictFromTar(bytes.NewReader(buf.Bytes()[:buf.Len()/2+100]), o); err == nil {
+		t.Fatal("want error for truncated archive")
+	}
+}
+
+func TestAdaptiveEntropy(t *testing.T) {
+	input := testSamples(1000, 31)
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdLevel: zstd.SpeedDefault, AdaptiveEntropy: true, Seed: 1}
+	d, stats, err := BuildZstdDictWithStats(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Samples != 900 {
+		t.Errorf("got %d samples, want 900 with 100 held out", stats.Samples)
+	}
+	info, err := InspectDict(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Raw != stats.EntropyTablesOmitted {
+		t.Fatalf("raw %v, tables omitted %v", info.Raw, stats.EntropyTablesOmitted)
+	}
+
+	// Check the decision against the holdout.
+	_, _, holdout := splitHoldout(input, nil)
+	o.AdaptiveEntropy = false
+	o.VerifyBenefit = true
+	full, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ToRawContent(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withTables, _, err := compressedSizes(full, holdout, o.ZstdLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contentOnly, _, err := compressedSizes(content, holdout, o.ZstdLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("holdout with tables %d, content only %d, omitted %v", withTables, contentOnly, stats.EntropyTablesOmitted)
+	if stats.EntropyTablesOmitted != (contentOnly <= withTables) {
+		t.Fatal("wrong decision")
+	}
+	if stats.EntropyTablesOmitted {
+		if !bytes.Equal(d, content) {
+			t.Fatal("content differs")
+		}
+	} else if !bytes.Equal(d, full) {
+		t.Fatal("dictionary differs")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	input := testSamples(500, 32)
+	dict, err := BuildZstdDict(input, Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Validate(dict); err != nil {
+		t.Fatal(err)
+	}
+	if err := Validate(dict[len(dict)-100:]); err != nil {
+		t.Fatalf("raw content: %v", err)
+	}
+	noID := append([]byte{}, dict...)
+	binary.LittleEndian.PutUint32(noID[4:], 0)
+	d, err := zstd.InspectDictionary(dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep 2 bytes of content, so the repeat offsets are outside it.
+	badOffsets := dict[:len(dict)-d.ContentSize()+2]
+	for name, b := range map[string][]byte{
+		"empty":   nil,
+		"header":  dict[:6],
+		"id":      noID,
+		"tables":  dict[:30],
+		"offsets": badOffsets,
+		"legacy":  append([]byte{0x35, 0xa4, 0x30, 0xec}, dict[4:]...),
+	} {
+		if err := Validate(b); err == nil {
+			t.Errorf("%s: want error", name)
+		} else {
+			t.Logf("%s: %v", name, err)
+		}
+	}
+}
+
+func FuzzValidate(f *testing.F) {
+	dict, err := BuildZstdDict(testSamples(500, 33), Options{MaxDictSize: 1024, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(dict)
+	f.Add(dict[:100])
+	f.Add(dict[len(dict)-100:])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if Validate(data) != nil || !bytes.HasPrefix(data, zstdDictMagic) {
+			return
+		}
+		// Valid dictionaries must be accepted by the decoder.
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderDicts(data))
+		if err != nil {
+			t.Fatalf("valid dictionary rejected by decoder: %v", err)
+		}
+		dec.Close()
+	})
+}
+
+func TestDirection(t *testing.T) {
+	// Samples that differ at the start and share their endings.
+	rng := rand.New(rand.NewSource(34))
+	endings := []string{
+		`","status":"completed","region":"eu-west-1","retries":0}`,
+		`","status":"failed","region":"us-east-2","retries":3}`,
+	}
+	input := make([][]byte, 1000)
+	for i := range input {
+		b := make([]byte, 8+rng.Intn(64))
+		for j := range b {
+			b[j] = byte('a' + rng.Intn(26))
+		}
+		input[i] = append(b, fmt.Sprintf(`{"request":"%d%s`, rng.Intn(1000), endings[rng.Intn(len(endings))])...)
+	}
+	o := Options{MaxDictSize: 1024, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	contents := make(map[Direction][]byte)
+	for _, dir := range []Direction{DirForward, DirBackward, DirBoth} {
+		o.Direction = dir
+		dict, segs, err := BuildZstdDictDebug(input, o)
+		if err != nil {
+			t.Fatal(dir, err)
+		}
+		for _, seg := range segs {
+			if seg.Frequency < 1 {
+				t.Errorf("%v: segment %q not found in samples", dir, seg.Content)
+			}
+		}
+		contents[dir], err = ToRawContent(dict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%v: coverage %.3f", dir, coverage(contents[dir], input, o.HashBytes))
+	}
+	fwd := coverage(contents[DirForward], input, o.HashBytes)
+	back := coverage(contents[DirBackward], input, o.HashBytes)
+	want := contents[DirForward]
+	if back > fwd {
+		want = contents[DirBackward]
+	}
+	if !bytes.Equal(contents[DirBoth], want) {
+		t.Error("DirBoth did not select the content with the highest coverage")
+	}
+
+	o.Direction = DirBoth + 1
+	if _, err := BuildZstdDict(input, o); err == nil {
+		t.Error("want error for unknown direction")
+	}
+}
+
+func TestScoreHistogram(t *testing.T) {
+	input := testSamples(1000, 35)
+	for _, algo := range []Algorithm{AlgoHash, AlgoCover, AlgoFastCover} {
+		t.Run(algo.String(), func(t *testing.T) {
+			o := Options{MaxDictSize: 1024, HashBytes: 6, Algorithm: algo, ZstdLevel: zstd.SpeedDefault}
+			_, stats, err := BuildZstdDictWithStats(input, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stats.ScoreHistogram) != scoreHistogramBuckets {
+				t.Fatalf("got %d buckets, want %d", len(stats.ScoreHistogram), scoreHistogramBuckets)
+			}
+			total := 0
+			for _, n := range stats.ScoreHistogram {
+				total += n
+			}
+			if total != stats.Candidates {
+				t.Errorf("histogram counts %d candidates, want %d", total, stats.Candidates)
+			}
+			t.Logf("%v", stats.ScoreHistogram)
+		})
+	}
+}
+
+func TestBuildOrderIndependent(t *testing.T) {
+	// Matches in these samples have many equal counts and offsets.
+	var input [][]byte
+	for i := 0; i < 200; i++ {
+		input = append(input, []byte(fmt.Sprintf("key=%03d;alpha=one;beta=two;gamma=three;delta=four;", i%50)))
+	}
+	o := Options{MaxDictSize: 1024, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	want, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(36))
+	for i := 0; i < 5; i++ {
+		rng.Shuffle(len(input), func(i, j int) { input[i], input[j] = input[j], input[i] })
+		o.Concurrency = i + 1
+		got, err := BuildZstdDict(input, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatal("dictionary depends on sample order")
+		}
+	}
+}
+
+func TestTimeBudget(t *testing.T) {
+	input := testSamples(2000, 37)
+	for _, algo := range []Algorithm{AlgoHash, AlgoCover, AlgoFastCover} {
+		t.Run(algo.String(), func(t *testing.T) {
+			o := Options{MaxDictSize: 4096, HashBytes: 6, Algorithm: algo, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+			_, full, err := BuildZstdDictWithStats(input, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if full.BudgetExceeded {
+				t.Error("budget exceeded without TimeBudget")
+			}
+			o.TimeBudget = time.Nanosecond
+			dict, stats, err := BuildZstdDictWithStats(input, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !stats.BudgetExceeded {
+				t.Error("budget not exceeded")
+			}
+			if stats.Selected != 1 || stats.ContentSize >= full.ContentSize {
+				t.Errorf("got %d segments, %d bytes, full build %d bytes", stats.Selected, stats.ContentSize, full.ContentSize)
+			}
+			if err := Validate(dict); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := EstimateRatio(dict, input[:100], zstd.SpeedDefault); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBuildZstdDictWithManifest(t *testing.T) {
+	input := testSamples(1000, 38)
+	o := Options{MaxDictSize: 1024, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	dict, m, err := BuildZstdDictWithManifest(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.DictID != 1234 || m.Size != len(dict) || m.Samples != len(input) || m.HashBytes != 6 || m.Algorithm != "hash" {
+		t.Errorf("unexpected manifest: %+v", m)
+	}
+	if m.Ratio <= 0 || m.Ratio >= 1 {
+		t.Errorf("unexpected ratio %v", m.Ratio)
+	}
+	if m.Created.IsZero() || m.BuildTime <= 0 {
+		t.Errorf("build time not set: %+v", m)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(string(b))
+	var got Manifest
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Created.Equal(m.Created) {
+		t.Errorf("created time changed: %v != %v", got.Created, m.Created)
+	}
+	got.Created = m.Created
+	if got != m {
+		t.Errorf("round trip mismatch: %+v != %+v", got, m)
+	}
+}
+
+func TestRequiredSegments(t *testing.T) {
+	input := testSamples(1000, 39)
+	required := [][]byte{[]byte("X-Protocol-Version: 7\r\n"), []byte(`"created":"2023-01-`)}
+	for _, algo := range []Algorithm{AlgoHash, AlgoCover, AlgoFastCover} {
+		t.Run(algo.String(), func(t *testing.T) {
+			o := Options{MaxDictSize: 1024, HashBytes: 6, Algorithm: algo, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault, RequiredSegments: required}
+			dict, segs, err := BuildZstdDictDebug(input, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := ToRawContent(dict)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasSuffix(content, bytes.Join(required, nil)) {
+				t.Errorf("required segments not at the end of content: %q", content[len(content)-64:])
+			}
+			if len(content) > o.MaxDictSize || len(content) < o.MaxDictSize/2 {
+				t.Errorf("content size %d, max %d", len(content), o.MaxDictSize)
+			}
+			if len(segs) < 2 || !bytes.Equal(segs[0].Content, required[1]) || !bytes.Equal(segs[1].Content, required[0]) {
+				t.Fatal("required segments not ranked first")
+			}
+			for _, seg := range segs[2:] {
+				if containedInAny(seg.Content, required) {
+					t.Errorf("selected segment %q is contained in a required segment", seg.Content)
+				}
+			}
+		})
+	}
+
+	o := Options{MaxDictSize: 40, HashBytes: 6, ZstdLevel: zstd.SpeedDefault, RequiredSegments: required}
+	_, err := BuildZstdDict(input, o)
+	if err == nil || !strings.Contains(err.Error(), "by 2 bytes") {
+		t.Errorf("want overflow error, got %v", err)
+	}
+	o.MaxDictSize = 42
+	o.ZstdDictID = 1234
+	dict, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ToRawContent(dict); !bytes.Equal(content, bytes.Join(required, nil)) {
+		t.Errorf("want only required content, got %q", content)
+	}
+}
+
+func TestAnalyzeSamples(t *testing.T) {
+	input := [][]byte{[]byte("aaaaaaaaaa"), []byte("abababab"), []byte("abcdefghijklmnopqrstuvwxyz"), []byte("abc")}
+	s, err := AnalyzeSamples(input, Options{HashBytes: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CorpusStats{Samples: 4, TotalBytes: 47, MinLength: 3, MedianLength: 10, MaxLength: 26, UniqueMatches: 1 + 2 + 23}
+	got := s
+	got.Entropy = 0
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if s.Entropy <= 0 || s.Entropy > 8 {
+		t.Errorf("unexpected entropy %v", s.Entropy)
+	}
+	s, err = AnalyzeSamples([][]byte{bytes.Repeat([]byte{'x'}, 100)}, Options{HashBytes: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Entropy != 0 || s.UniqueMatches != 1 {
+		t.Errorf("uniform sample: got %+v", s)
+	}
+	if _, err := AnalyzeSamples(nil, Options{HashBytes: 6}); !errors.Is(err, ErrNoSamples) {
+		t.Errorf("want ErrNoSamples, got %v", err)
+	}
+	if _, err := AnalyzeSamples(input, Options{}); err == nil {
+		t.Error("want error for missing HashBytes")
+	}
+}
+
+func TestWindowLog(t *testing.T) {
+	input := testSamples(1000, 40)
+	var out bytes.Buffer
+	o := Options{MaxDictSize: 4096, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault, WindowLog: 10, Output: &out}
+	_, stats, err := BuildZstdDictWithStats(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ContentSize > 1024 {
+		t.Errorf("content size %d exceeds window", stats.ContentSize)
+	}
+	if !strings.Contains(out.String(), "exceeds window size 1024") {
+		t.Errorf("no warning in output: %q", out.String())
+	}
+
+	out.Reset()
+	o.MaxDictSize = 1024
+	if _, err := BuildZstdDict(input, o); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "Warning") {
+		t.Errorf("unexpected warning: %q", out.String())
+	}
+
+	for _, wl := range []int{-1, 9, 32} {
+		o.WindowLog = wl
+		if _, err := BuildZstdDict(input, o); err == nil {
+			t.Errorf("WindowLog %d: want error", wl)
+		}
+	}
+}
+
+func TestDictInterface(t *testing.T) {
+	input := testSamples(1000, 41)
+	o := Options{MaxDictSize: 1024, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	zb, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := BuildFlateDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.ZstdDictID = 0
+	o.RawContentOnly = true
+	rb, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zd, err := NewZstdDict(zb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd, err := NewZstdDict(rb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := NewFlateDict(fb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ToRawContent(zb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		d       Dict
+		format  string
+		id      uint32
+		content []byte
+	}{
+		{d: zd, format: "zstd", id: 1234, content: content},
+		{d: rd, format: "zstd", id: 0, content: rb},
+		{d: fd, format: "flate", id: FlateDictAdler32(fb), content: fb},
+	} {
+		if tc.d.Format() != tc.format || tc.d.ID() != tc.id || !bytes.Equal(tc.d.Content(), tc.content) {
+			t.Errorf("got %s dict with ID %d, want %s with ID %d", tc.d.Format(), tc.d.ID(), tc.format, tc.id)
+		}
+	}
+	if !bytes.Equal(zd.Bytes(), zb) || !bytes.Equal(fd.Bytes(), fb) {
+		t.Error("Bytes does not return the dictionary")
+	}
+	if _, err := NewZstdDict(zb[:6]); err == nil {
+		t.Error("want error for truncated dictionary")
+	}
+	if _, err := NewFlateDict(nil); err == nil {
+		t.Error("want error for empty dictionary")
+	}
+}
+
+func TestPadToMaxDictSize(t *testing.T) {
+	input := testSamples(1000, 42)
+	build := map[string]func([][]byte, Options) ([]byte, error){
+		"zstd":  BuildZstdDict,
+		"raw":   BuildRawDict,
+		"flate": BuildFlateDict,
+	}
+	for name, fn := range build {
+		t.Run(name, func(t *testing.T) {
+			// Few samples leave the content smaller than MaxDictSize.
+			for _, samples := range [][][]byte{input, input[:20]} {
+				o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault, PadToMaxDictSize: true}
+				dict, err := fn(samples, o)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(dict) != o.MaxDictSize {
+					t.Fatalf("got %d bytes, want %d", len(dict), o.MaxDictSize)
+				}
+				if err := Validate(dict); err != nil {
+					t.Fatal(err)
+				}
+				if name != "zstd" {
+					continue
+				}
+				ratio, err := EstimateRatio(dict, input[:100], zstd.SpeedDefault)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ratio >= 1 {
+					t.Errorf("padded dictionary does not compress: %v", ratio)
+				}
+			}
+		})
+	}
+	o := Options{MaxDictSize: 2048, HashBytes: 6, PadToMaxDictSize: true}
+	if _, err := BuildS2Dict(input, o); err == nil {
+		t.Error("want error for S2")
+	}
+	o.MaxDictSize = 64
+	o.ZstdLevel = zstd.SpeedDefault
+	if _, err := BuildZstdDict(input, o); err == nil {
+		t.Error("want error when tables exceed MaxDictSize")
+	}
+}
+
+func TestCheckLevelMatch(t *testing.T) {
+	input := testSamples(500, 43)
+	o := Options{MaxDictSize: 1024, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	dict, m, err := BuildZstdDictWithManifest(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ZstdLevel != "default" {
+		t.Errorf("manifest level %q, want default", m.ZstdLevel)
+	}
+	if ok, err := CheckLevelMatch(dict, m, zstd.SpeedDefault); !ok || err != nil {
+		t.Errorf("same level: got %v, %v", ok, err)
+	}
+	if ok, err := CheckLevelMatch(dict, m, zstd.SpeedBestCompression); ok || err != nil {
+		t.Errorf("other level: got %v, %v", ok, err)
+	}
+	other := m
+	other.DictID++
+	if _, err := CheckLevelMatch(dict, other, zstd.SpeedDefault); err == nil {
+		t.Error("want error for manifest of another dictionary")
+	}
+	other = m
+	other.ZstdLevel = ""
+	if _, err := CheckLevelMatch(dict, other, zstd.SpeedDefault); err == nil {
+		t.Error("want error for missing level")
+	}
+
+	o.ZstdLevel = 0
+	_, stats, err := BuildZstdDictWithStats(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ZstdLevel != zstd.SpeedBestCompression {
+		t.Errorf("default level recorded as %v", stats.ZstdLevel)
+	}
+}
+
+func TestBuildZstdDictFromDir(t *testing.T) {
+	dir := t.TempDir()
+	input := testSamples(600, 68)
+	top, sub := input[:300], input[300:]
+	write := func(dir string, samples [][]byte) {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		for i, b := range samples {
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%04d.json", i)), b, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write(dir, top)
+	write(filepath.Join(dir, "sub"), sub)
+	// Links are skipped, so the linked file is not used twice.
+	if err := os.Symlink(filepath.Join(dir, "0000.json"), filepath.Join(dir, "link.json")); err != nil {
+		t.Log("symlinks not supported:", err)
+	}
+
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	for _, recursive := range []bool{false, true} {
+		o.Recursive = recursive
+		got, err := BuildZstdDictFromDir(dir, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := top
+		if recursive {
+			want = input
+		}
+		wantDict, err := BuildZstdDict(want, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, wantDict) {
+			t.Errorf("Recursive %v: dictionary differs from BuildZstdDict", recursive)
+		}
+	}
+
+	if _, err := BuildZstdDictFromDir(t.TempDir(), o); !errors.Is(err, ErrNoSamples) {
+		t.Errorf("empty directory: want ErrNoSamples, got %v", err)
+	}
+	if _, err := BuildZstdDictFromDir(filepath.Join(dir, "missing"), o); err == nil {
+		t.Error("want error for missing directory")
+	}
+}
+
+func TestBuildZstdDictFromReader(t *testing.T) {
+	input := testSamples(1000, 64)
+	var stream bytes.Buffer
+	for _, b := range input {
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(b)))
+		stream.Write(hdr[:])
+		stream.Write(b)
+	}
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault, MaxSampleSize: 100}
+	got, err := BuildZstdDictFromReader(bytes.NewReader(stream.Bytes()), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("dictionary differs from BuildZstdDict")
+	}
+
+	// MaxSamples keeps the same selection for the same seed.
+	o.MaxSamples = 200
+	o.Seed = 5
+	a, err := BuildZstdDictFromReader(bytes.NewReader(stream.Bytes()), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := BuildZstdDictFromReader(bytes.NewReader(stream.Bytes()), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Error("MaxSamples: output differs for same seed")
+	}
+
+	if _, err := BuildZstdDictFromReader(bytes.NewReader(nil), o); !errors.Is(err, ErrNoSamples) {
+		t.Errorf("empty stream: want ErrNoSamples, got %v", err)
+	}
+	for _, n := range []int{2, 10} {
+		_, err := BuildZstdDictFromReader(bytes.NewReader(stream.Bytes()[:stream.Len()-n]), o)
+		if !errors.Is(err, io.ErrUnexpectedEOF) || !strings.Contains(err.Error(), "sample 999") {
+			t.Errorf("truncated by %d bytes: got %v", n, err)
+		}
+	}
+	partial := append(append([]byte(nil), stream.Bytes()...), 0, 0)
+	_, err = BuildZstdDictFromReader(bytes.NewReader(partial), o)
+	if !errors.Is(err, io.ErrUnexpectedEOF) || !strings.Contains(err.Error(), "sample 1000 length") {
+		t.Errorf("truncated length: got %v", err)
+	}
+}
+
+func TestSampleReservoir(t *testing.T) {
+	res := sampleReservoir{max: 10, rng: rand.New(rand.NewSource(1))}
+	buf := make([]byte, 4)
+	for i := 0; i < 1000; i++ {
+		binary.BigEndian.PutUint32(buf, uint32(i))
+		res.add(buf)
+	}
+	got := res.result()
+	if len(got) != 10 {
+		t.Fatalf("got %d samples, want 10", len(got))
+	}
+	for i := 1; i < len(got); i++ {
+		if binary.BigEndian.Uint32(got[i-1]) >= binary.BigEndian.Uint32(got[i]) {
+			t.Fatal("samples not in stream order")
+		}
+	}
+	if binary.BigEndian.Uint32(got[len(got)-1]) < 100 {
+		t.Error("only early samples kept")
+	}
+
+	// Limit the bytes kept, with samples of varying size.
+	const maxBytes = 10 << 10
+	res = sampleReservoir{maxBytes: maxBytes, rng: rand.New(rand.NewSource(2))}
+	rng := rand.New(rand.NewSource(3))
+	var peak int64
+	for i := 0; i < 10000; i++ {
+		b := make([]byte, 4+rng.Intn(1000))
+		binary.BigEndian.PutUint32(b, uint32(i))
+		res.add(b)
+		var kept int64
+		for _, s := range res.samples {
+			kept += int64(len(s.b))
+		}
+		if kept != res.bytes {
+			t.Fatalf("sample %d: %d bytes kept, counted %d", i, kept, res.bytes)
+		}
+		if kept > peak {
+			peak = kept
+		}
+	}
+	// A sample larger than the limit is skipped.
+	res.add(make([]byte, maxBytes+1))
+	if peak > maxBytes || res.bytes > maxBytes {
+		t.Fatalf("peak of %d bytes kept, limit %d", peak, maxBytes)
+	}
+	got = res.result()
+	if len(got) < 10 {
+		t.Fatalf("got %d samples", len(got))
+	}
+	for i := 1; i < len(got); i++ {
+		if binary.BigEndian.Uint32(got[i-1]) >= binary.BigEndian.Uint32(got[i]) {
+			t.Fatal("samples not in stream order")
+		}
+	}
+	if binary.BigEndian.Uint32(got[len(got)-1]) < 1000 {
+		t.Error("only early samples kept")
+	}
+}
+
+func TestBuildZstdDictFromCompressed(t *testing.T) {
+	input := testSamples(1000, 44)
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	compressed := make([][]byte, len(input))
+	for i, b := range input {
+		compressed[i] = enc.EncodeAll(b, nil)
+	}
+	for _, maxSize := range []int{0, 100} {
+		o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault, MaxSampleSize: maxSize}
+		want, err := BuildZstdDict(input, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []int{1, 4} {
+			o.Concurrency = c
+			got, err := BuildZstdDictFromCompressed(compressed, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("MaxSampleSize %d, Concurrency %d: dictionary differs from BuildZstdDict", maxSize, c)
+			}
+		}
+	}
+
+	// MaxMemoryBytes keeps a random selection of the decompressed samples within the limit.
+	var total int
+	for _, b := range input {
+		total += len(b)
+	}
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault, MaxMemoryBytes: int64(total / 4), Seed: 83}
+	res := sampleReservoir{maxBytes: o.MaxMemoryBytes, rng: o.rand()}
+	for _, b := range input {
+		res.add(b)
+	}
+	kept := res.result()
+	var keptBytes int
+	for _, b := range kept {
+		keptBytes += len(b)
+	}
+	if keptBytes > total/4 || len(kept) < len(input)/5 {
+		t.Fatalf("%d samples of %d bytes kept, limit %d bytes", len(kept), keptBytes, total/4)
+	}
+	want, err := BuildZstdDict(kept, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []int{1, 4} {
+		o.Concurrency = c
+		got, err := BuildZstdDictFromCompressed(compressed, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("MaxMemoryBytes, Concurrency %d: dictionary differs from building with the kept samples", c)
+		}
+	}
+
+	compressed[10] = compressed[10][:len(compressed[10])/2]
+	compressed[700] = compressed[700][:len(compressed[700])/2]
+	for _, c := range []int{1, 4} {
+		_, err = BuildZstdDictFromCompressed(compressed, Options{MaxDictSize: 2048, HashBytes: 6, Concurrency: c})
+		if err == nil || !strings.Contains(err.Error(), "sample 10:") {
+			t.Errorf("Concurrency %d: want error for truncated sample 10, got %v", c, err)
+		}
+	}
+}
+
+func TestBuildZstdDictToTarget(t *testing.T) {
+	input := testSamples(1000, 71)
+	o := Options{HashBytes: 6, ZstdLevel: zstd.SpeedDefault}
+	const maxSize = 8 << 10
+	// The ratio of the first attempt is always met.
+	_, first, err := BuildZstdDictToTarget(input, 1, maxSize, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first > 1 {
+		t.Fatalf("ratio %v above target 1", first)
+	}
+	d, ratio, err := BuildZstdDictToTarget(input, first, maxSize, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ratio > first {
+		t.Errorf("ratio %v above target %v", ratio, first)
+	}
+	info, err := zstd.InspectDictionary(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentSize() > targetStartSize {
+		t.Errorf("content size %d, want first attempt of %d bytes", info.ContentSize(), targetStartSize)
+	}
+
+	// An unreachable target returns the dictionary of maxSize.
+	d, ratio, err = BuildZstdDictToTarget(input, 0.001, maxSize, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ratio <= 0.001 {
+		t.Errorf("unreachable ratio %v met", ratio)
+	}
+	info, err = zstd.InspectDictionary(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentSize() > maxSize || info.ContentSize() <= targetStartSize {
+		t.Errorf("content size %d, want up to maxSize %d", info.ContentSize(), maxSize)
+	}
+
+	if _, _, err := BuildZstdDictToTarget(input, 0, maxSize, o); err == nil {
+		t.Error("want error for target ratio 0")
+	}
+	if _, _, err := BuildZstdDictToTarget(input, 0.5, 7, o); err == nil {
+		t.Error("want error for maxSize 7")
+	}
+	if _, _, err := BuildZstdDictToTarget(nil, 0.5, maxSize, o); !errors.Is(err, ErrNoSamples) {
+		t.Errorf("want ErrNoSamples, got %v", err)
+	}
+}
+
+func TestFindSweetSpot(t *testing.T) {
+	input := testSamples(1000, 46)
+	sizes := []int{16 << 10, 256, 1024, 4096}
+	o := Options{HashBytes: 6, ZstdLevel: zstd.SpeedDefault}
+	best, stats, err := FindSweetSpot(input, sizes, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != len(sizes) {
+		t.Fatalf("got ratios for %d sizes, want %d", len(stats), len(sizes))
+	}
+	if _, ok := stats[best]; !ok {
+		t.Fatalf("best size %d is not a candidate", best)
+	}
+	t.Log("best size", best, "ratios", stats)
+	if stats[256] <= stats[best] && best != 256 {
+		t.Errorf("best size %d ratio %v does not improve on %v", best, stats[best], stats[256])
+	}
+	sort.Ints(sizes)
+	for i, size := range sizes[:len(sizes)-1] {
+		if size != best {
+			continue
+		}
+		next := sizes[i+1]
+		if gain := (stats[size] - stats[next]) / float64(next-size) * 1024; gain >= sweetSpotMinGain {
+			t.Errorf("size %d gains %v per KiB over best size %d", next, gain, size)
+		}
+	}
+	if _, _, err := FindSweetSpot(input, nil, o); err == nil {
+		t.Error("want error for no sizes")
+	}
+}
+
+func TestBuildZstdDictPreview(t *testing.T) {
+	input := testSamples(1000, 45)
+	o := Options{MaxDictSize: 4096, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	_, all, err := BuildZstdDictDebug(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const topN = 3
+	if len(all) <= topN {
+		t.Fatalf("want more than %d segments, got %d", topN, len(all))
+	}
+	d, segs, err := BuildZstdDictPreview(input, topN, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != topN {
+		t.Fatalf("want %d segments, got %d", topN, len(segs))
+	}
+	size := 0
+	for i, seg := range segs {
+		if !bytes.Equal(seg.Content, all[i].Content) || seg.Score != all[i].Score || seg.Frequency != all[i].Frequency {
+			t.Errorf("segment %d differs from BuildZstdDictDebug", i)
+		}
+		size += len(seg.Content)
+	}
+	zd, err := NewZstdDict(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zd.Content()) != size {
+		t.Errorf("want content size %d, got %d", size, len(zd.Content()))
+	}
+	if !bytes.HasSuffix(zd.Content(), segs[0].Content) {
+		t.Error("top segment is not at the end of the content")
+	}
+	if _, _, err := BuildZstdDictPreview(input, 0, o); err == nil {
+		t.Error("want error for topN 0")
+	}
+}
+
+func TestAutoDictID(t *testing.T) {
+	dictID := func(input [][]byte, seed int64) uint32 {
+		d, err := BuildZstdDict(input, Options{MaxDictSize: 2048, HashBytes: 6, ZstdLevel: zstd.SpeedDefault, AutoDictID: true, Seed: seed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := zstd.InspectDictionary(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.ID()
+	}
+	input := testSamples(1000, 69)
+	id := dictID(input, 1)
+	if id < 32768 || id >= 1<<31 {
+		t.Errorf("ID %d in reserved range", id)
+	}
+	if again := dictID(input, 2); again != id {
+		t.Errorf("ID %d for same content, want %d", again, id)
+	}
+	if other := dictID(testSamples(1000, 70), 1); other == id {
+		t.Errorf("same ID %d for different content", id)
+	}
+	for i := 0; i < 1000; i++ {
+		if id := contentDictID([]byte(fmt.Sprint(i))); id < 32768 || id >= 1<<31 {
+			t.Fatalf("content %d: ID %d in reserved range", i, id)
+		}
+	}
+}
+
+func TestSearchDepth(t *testing.T) {
+	input := testSamples(1000, 76)
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	unlimited, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.SearchDepth = 1
+	limited, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(unlimited, limited) {
+		t.Error("SearchDepth 1 did not change the dictionary")
+	}
+	o.SearchDepth = 1 << 20
+	deep, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unlimited, deep) {
+		t.Error("SearchDepth above the number of neighbors changed the dictionary")
+	}
+	o.SearchDepth = -1
+	if _, err := BuildZstdDict(input, o); err == nil {
+		t.Error("want error for negative SearchDepth")
+	}
+}
+
+func TestMinSampleSize(t *testing.T) {
+	long := testSamples(1000, 77)
+	var input [][]byte
+	for i, b := range long {
+		input = append(input, b)
+		if i%4 == 0 {
+			// Short samples repeating a string that would otherwise be selected.
+			input = append(input, []byte("<short sample filler>"))
+		}
+	}
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault, MinSampleSize: 50}
+	got, stats, err := BuildZstdDictWithStats(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TooSmall != 250 || stats.Samples != len(long) {
+		t.Errorf("got %d samples removed, %d used; want 250 and %d", stats.TooSmall, stats.Samples, len(long))
+	}
+	want, err := BuildZstdDict(long, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("dictionary differs from building without the short samples")
+	}
+	if bytes.Contains(got, []byte("short sample")) {
+		t.Error("content of short samples in dictionary")
+	}
+	o.MinSampleSize = 1 << 10
+	if _, err := BuildZstdDict(input, o); !errors.Is(err, ErrNoSamples) {
+		t.Errorf("all samples removed: want ErrNoSamples, got %v", err)
+	}
+}
+
+func TestMaxSampleSize(t *testing.T) {
+	input := testSamples(300, 26)
+	orig := make([][]byte, len(input))
+	copy(orig, input)
+	// A few oversized samples, which would otherwise dominate the dictionary.
+	for i := 0; i < 3; i++ {
+		big := bytes.Repeat([]byte(fmt.Sprintf("<oversized %d>", i)), 10000)
+		input[i*100] = append(append([]byte(nil), input[i*100]...), big...)
+	}
+	withBig := make([][]byte, len(input))
+	copy(withBig, input)
+
+	var buf bytes.Buffer
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault, MaxSampleSize: 200, Output: &buf}
+	got, stats, err := BuildZstdDictWithStats(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Truncated != 3 {
+		t.Errorf("got %d samples truncated, want 3", stats.Truncated)
+	}
+	if !strings.Contains(buf.String(), "Truncated 3 samples to 200 bytes\n") {
+		t.Errorf("truncation not reported in output: %q", buf.String())
+	}
+	if bytes.Contains(got, []byte("<oversized")) {
+		t.Error("content of truncated part in dictionary")
+	}
+	for i := range input {
+		if &input[i][0] != &withBig[i][0] || len(input[i]) != len(withBig[i]) {
+			t.Fatalf("sample %d modified", i)
+		}
+	}
+
+	var stats2 DictStats
+	res := truncateSamples(input, 200, &stats2)
+	if stats2.Truncated != 3 {
+		t.Errorf("truncateSamples: got %d samples truncated, want 3", stats2.Truncated)
+	}
+	for i, b := range res {
+		want := input[i]
+		if len(want) > 200 {
+			want = want[:200]
+		}
+		if !bytes.Equal(b, want) {
+			t.Fatalf("sample %d: got %d bytes, want the first %d bytes", i, len(b), len(want))
+		}
+		if len(input[i]) != len(withBig[i]) {
+			t.Fatalf("sample %d: input modified", i)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if !bytes.HasPrefix(res[i*100], orig[i*100]) {
+			t.Errorf("sample %d: prefix not kept", i*100)
+		}
+	}
+
+	// Without oversized samples the input is returned as is.
+	var stats3 DictStats
+	if res := truncateSamples(orig, 1<<20, &stats3); &res[0] != &orig[0] || stats3.Truncated != 0 {
+		t.Error("input without oversized samples changed")
+	}
+}
+
+func TestVerifyBenefit(t *testing.T) {
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdLevel: zstd.SpeedDefault, VerifyBenefit: true}
+	if _, err := BuildZstdDict(testSamples(1000, 78), o); err != nil {
+		t.Fatal(err)
+	}
+	// Random samples that repeat within themselves, but share no content,
+	// so a dictionary cannot help.
+	rng := rand.New(rand.NewSource(78))
+	random := make([][]byte, 500)
+	for i := range random {
+		b := make([]byte, 100)
+		rng.Read(b)
+		random[i] = append(b, b...)
+	}
+	if _, err := BuildZstdDict(random, o); !errors.Is(err, ErrNoBenefit) {
+		t.Errorf("random samples: want ErrNoBenefit, got %v", err)
+	}
+	o.MinImprovement = 0.9
+	if _, err := BuildZstdDict(testSamples(1000, 78), o); !errors.Is(err, ErrNoBenefit) {
+		t.Errorf("MinImprovement 0.9: want ErrNoBenefit, got %v", err)
+	}
+}
+
+func TestRand(t *testing.T) {
+	input := testSamples(1000, 79)
+	build := func(seed int64) []byte {
+		o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdLevel: zstd.SpeedDefault, MaxSamples: 500, Shuffle: true, Rand: rand.New(rand.NewSource(seed))}
+		d, err := BuildZstdDict(input, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	a, b := build(7), build(7)
+	if !bytes.Equal(a, b) {
+		t.Error("output differs for Rand with the same seed")
+	}
+	if bytes.Equal(a, build(8)) {
+		t.Error("output identical for Rand with different seeds")
+	}
+}
+
+func TestMaxSamples(t *testing.T) {
+	input := testSamples(1000, 80)
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault, MaxSamples: 300, Seed: 3}
+	a, stats, err := BuildZstdDictWithStats(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Samples != 300 {
+		t.Errorf("built from %d samples, want 300", stats.Samples)
+	}
+	b, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Error("output differs for the same Seed")
+	}
+	o.Seed = 4
+	if c, err := BuildZstdDict(input, o); err != nil || bytes.Equal(a, c) {
+		t.Errorf("same output for a different Seed: %v", err)
+	}
+	o.MaxSamples = len(input)
+	all, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.MaxSamples = 0
+	if want, err := BuildZstdDict(input, o); err != nil || !bytes.Equal(all, want) {
+		t.Errorf("MaxSamples equal to the number of samples changed the output: %v", err)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	input := testSamples(300, 81)
+	output := func(level LogLevel) string {
+		var buf bytes.Buffer
+		o := Options{MaxDictSize: 1024, HashBytes: 6, ZstdLevel: zstd.SpeedDefault, Output: &buf, LogLevel: level, Concurrency: 1}
+		if _, err := BuildZstdDict(input, o); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	if s := output(LogSilent); s != "" {
+		t.Errorf("LogSilent wrote %q", s)
+	}
+	info := output(LogInfo)
+	if !strings.Contains(info, "300 inputs indexed") || strings.Contains(info, "re-indexed") {
+		t.Errorf("LogInfo wrote %q", info)
+	}
+	if def := output(LogDefault); def != info {
+		t.Errorf("LogDefault wrote %q, want LogInfo output", def)
+	}
+	debug := output(LogDebug)
+	if !strings.HasPrefix(debug, strings.SplitAfter(info, "\n")[0]) || !strings.Contains(debug, "re-indexed") {
+		t.Errorf("LogDebug output lacks info or debug messages")
+	}
+	// Without Output nothing is written, whatever the level.
+	o := Options{MaxDictSize: 1024, HashBytes: 6, ZstdLevel: zstd.SpeedDefault, LogLevel: LogDebug}
+	if o.logLevel() != LogSilent {
+		t.Errorf("log level %v without Output", o.logLevel())
+	}
+}
+
+func TestProgress(t *testing.T) {
+	input := testSamples(1000, 82)
+	for _, algo := range []Algorithm{AlgoHash, AlgoCover, AlgoFastCover} {
+		t.Run(algo.String(), func(t *testing.T) {
+			type call struct{ done, total int }
+			var calls []call
+			o := Options{MaxDictSize: 2048, HashBytes: 6, Algorithm: algo, Concurrency: 4, ZstdLevel: zstd.SpeedDefault}
+			o.Progress = func(done, total int) {
+				calls = append(calls, call{done, total})
+			}
+			if _, err := BuildZstdDict(input, o); err != nil {
+				t.Fatal(err)
+			}
+			if len(calls) == 0 || calls[0].total != len(input) {
+				t.Fatalf("first step is not indexing %d samples: %v", len(input), calls)
+			}
+			// A step ends when done reaches total, and the next step starts over.
+			steps := 0
+			for i, c := range calls {
+				if c.done < 0 || c.done > c.total {
+					t.Fatalf("call %d: done %d, total %d", i, c.done, c.total)
+				}
+				if i > 0 && calls[i-1].done != calls[i-1].total {
+					if prev := calls[i-1]; c.total != prev.total || c.done < prev.done {
+						t.Fatalf("call %d: %v after %v before step completed", i, c, prev)
+					}
+				}
+				if c.done == c.total {
+					steps++
+				}
+			}
+			if last := calls[len(calls)-1]; last.done != last.total {
+				t.Errorf("last call %v did not complete", last)
+			}
+			if steps < 2 {
+				t.Errorf("%d steps completed, want indexing and selection", steps)
+			}
+			if len(calls) > steps*100 {
+				t.Errorf("%d calls for %d steps", len(calls), steps)
+			}
+		})
+	}
+}
+
+func TestMinDictSize(t *testing.T) {
+	input := testSamples(100, 67)
+	o := Options{MaxDictSize: 64 << 10, HashBytes: 6, ZstdLevel: zstd.SpeedDefault, MinDictSize: 32 << 10}
+	_, err := BuildZstdDict(input, o)
+	if !errors.Is(err, ErrDictTooSmall) {
+		t.Fatalf("want ErrDictTooSmall, got %v", err)
+	}
+	o.PadToMaxDictSize = true
+	d, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatalf("padded: %v", err)
+	}
+	if len(d) < o.MinDictSize {
+		t.Errorf("padded dictionary is %d bytes", len(d))
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	input := testSamples(100, 14)
+	for _, tc := range []struct {
+		hashBytes, maxDictSize int
+		err                    string
+	}{
+		{hashBytes: 0, maxDictSize: 1024, err: "dict: HashBytes must be between 3 and 8, got 0"},
+		{hashBytes: 2, maxDictSize: 1024, err: "dict: HashBytes must be between 3 and 8, got 2"},
+		{hashBytes: 3, maxDictSize: 1024},
+		{hashBytes: 8, maxDictSize: 1024},
+		{hashBytes: 9, maxDictSize: 1024, err: "dict: HashBytes must be between 3 and 8, got 9"},
+		{hashBytes: 6, maxDictSize: 0, err: "dict: MaxDictSize must be at least 8, got 0"},
+		{hashBytes: 6, maxDictSize: 7, err: "dict: MaxDictSize must be at least 8, got 7"},
+	} {
+		o := Options{MaxDictSize: tc.maxDictSize, HashBytes: tc.hashBytes, ZstdLevel: zstd.SpeedDefault}
+		_, err := BuildZstdDict(input, o)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("HashBytes %d, MaxDictSize %d: %v", tc.hashBytes, tc.maxDictSize, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("HashBytes %d, MaxDictSize %d: got error %v, want %q", tc.hashBytes, tc.maxDictSize, err, tc.err)
+		}
+	}
+}
+
+func TestMaxDictSizeTooLarge(t *testing.T) {
+	input := testSamples(100, 46)
+	for _, o := range []Options{
+		{MaxDictSize: math.MaxInt, HashBytes: 6},
+		{MaxDictSize: 1 << 20, HashBytes: 6, MaxMemoryBytes: 1 << 16},
+	} {
+		_, err := BuildZstdDict(input, o)
+		if !errors.Is(err, ErrDictSizeTooLarge) {
+			t.Errorf("MaxDictSize %d, MaxMemoryBytes %d: want ErrDictSizeTooLarge, got %v", o.MaxDictSize, o.MaxMemoryBytes, err)
+		}
+	}
+	// WindowLog reduces MaxDictSize before it is checked.
+	_, err := BuildZstdDict(input, Options{MaxDictSize: math.MaxInt, HashBytes: 6, WindowLog: 12, ZstdLevel: zstd.SpeedDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrainerReset(t *testing.T) {
+	first := testSamples(1000, 47)
+	second := testSamples(1000, 48)
+	for _, o := range []Options{
+		{MaxDictSize: 2048, HashBytes: 6, Seed: 1, ZstdLevel: zstd.SpeedDefault},
+		{MaxDictSize: 2048, HashBytes: 6, Seed: 1, ZstdLevel: zstd.SpeedDefault, MaxMemoryBytes: 1000 * hashCountBytes},
+	} {
+		tr := NewTrainer(o)
+		for _, b := range first {
+			tr.Add(b)
+		}
+		if _, err := tr.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		tr.Reset()
+		if _, err := tr.Finish(); !errors.Is(err, ErrNoSamples) {
+			t.Fatalf("want ErrNoSamples after Reset, got %v", err)
+		}
+		fresh := NewTrainer(o)
+		for _, b := range second {
+			tr.Add(b)
+			fresh.Add(b)
+		}
+		got, err := tr.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := fresh.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("MaxMemoryBytes %d: reset trainer dictionary differs from new trainer", o.MaxMemoryBytes)
+		}
+	}
+}
+
+func TestWeightByDifficulty(t *testing.T) {
+	rng := rand.New(rand.NewSource(49))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	easyToken, hardToken := random(64), random(64)
+	var input [][]byte
+	for i := 0; i < 100; i++ {
+		input = append(input, append(bytes.Repeat([]byte{'a'}, 1000), easyToken...))
+	}
+	for i := 0; i < 60; i++ {
+		input = append(input, append(random(1000), hardToken...))
+	}
+	o := Options{MaxDictSize: 64, HashBytes: 6, Concurrency: 4}
+	d, err := BuildRawDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(d, hardToken[8:56]) {
+		t.Fatal("content from incompressible samples selected without WeightByDifficulty")
+	}
+	o.WeightByDifficulty = true
+	d, err = BuildRawDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(d, hardToken[8:56]) {
+		t.Error("content from incompressible samples not selected with WeightByDifficulty")
+	}
+	o.Concurrency = 1
+	d1, err := BuildRawDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d, d1) {
+		t.Error("output depends on Concurrency")
+	}
+}
+
+func TestSingleSample(t *testing.T) {
+	rng := rand.New(rand.NewSource(51))
+	token := make([]byte, 100)
+	rng.Read(token)
+	sample := make([]byte, 0, 4000)
+	for i := 0; i < 8; i++ {
+		filler := make([]byte, 400)
+		rng.Read(filler)
+		sample = append(append(sample, filler...), token...)
+	}
+	for _, algo := range []Algorithm{AlgoHash, AlgoCover, AlgoFastCover} {
+		o := Options{MaxDictSize: 256, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault, Algorithm: algo, SegmentSize: 64}
+		d, stats, err := BuildZstdDictWithStats([][]byte{sample}, o)
+		if err != nil {
+			t.Fatalf("%v: %v", algo, err)
+		}
+		if stats.SamplesUsed != 1 {
+			t.Errorf("%v: want 1 sample used, got %d", algo, stats.SamplesUsed)
+		}
+		zd, err := NewZstdDict(d)
+		if err != nil {
+			t.Fatalf("%v: %v", algo, err)
+		}
+		if !bytes.Contains(zd.Content(), token[36:64]) {
+			t.Errorf("%v: repeated string not in content", algo)
+		}
+
+		// Nothing is repeated.
+		if _, err := BuildZstdDict([][]byte{token}, o); err != nil {
+			t.Errorf("%v: unrepeated sample: %v", algo, err)
+		}
+		if _, err := BuildZstdDict([][]byte{{}, nil, []byte("short")}, o); !errors.Is(err, ErrSamplesTooSmall) {
+			t.Errorf("%v: want ErrSamplesTooSmall, got %v", algo, err)
+		}
+	}
+
+	o := Options{MaxDictSize: 256, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	tr := NewTrainer(o)
+	tr.Add(sample)
+	got, err := tr.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := BuildZstdDict([][]byte{sample}, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("trainer dictionary differs from BuildZstdDict")
+	}
+}
+
+func TestDictDiff(t *testing.T) {
+	input := testSamples(1000, 52)
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault}
+	a, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.ZstdDictID = 1235
+	b, err := BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ToRawContent(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := DictDiff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.IDChanged || d.IDA != 1234 || d.IDB != 1235 {
+		t.Errorf("unexpected IDs: %+v", d)
+	}
+	if d.Overlap != 1 || d.SharedA != len(content) || d.OnlyA != 0 || d.OnlyB != 0 {
+		t.Errorf("same content: unexpected diff %+v", d)
+	}
+
+	unrelated := make([]byte, 1000)
+	rand.New(rand.NewSource(53)).Read(unrelated)
+	d, err = DictDiff(a, unrelated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.IDB != 0 || !d.IDChanged {
+		t.Errorf("raw content: unexpected IDs: %+v", d)
+	}
+	if d.Overlap > 0.05 || d.OnlyB < 950 || d.SharedA+d.OnlyA != len(content) {
+		t.Errorf("unrelated content: unexpected diff %+v", d)
+	}
+
+	if _, err := DictDiff(a, nil); err == nil {
+		t.Error("want error for empty dictionary")
+	}
+}
+
+func TestHashFunc(t *testing.T) {
+	input := testSamples(1000, 54)
+	var calls int64
+	fnv := func(b []byte) uint64 {
+		if len(b) != 6 {
+			panic(fmt.Sprintf("hash called with %d bytes", len(b)))
+		}
+		atomic.AddInt64(&calls, 1)
+		h := uint64(14695981039346656037)
+		for _, c := range b {
+			h ^= uint64(c)
+			h *= 1099511628211
+		}
+		return h
+	}
+	for _, algo := range []Algorithm{AlgoHash, AlgoCover, AlgoFastCover} {
+		o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault, Algorithm: algo}
+		want, err := BuildZstdDict(input, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls = 0
+		o.HashFunc = fnv
+		got, err := BuildZstdDict(input, o)
+		if err != nil {
+			t.Fatalf("%v: %v", algo, err)
+		}
+		if err := Validate(got); err != nil {
+			t.Fatalf("%v: %v", algo, err)
+		}
+		if algo == AlgoFastCover {
+			if calls != 0 || !bytes.Equal(got, want) {
+				t.Errorf("%v: HashFunc used", algo)
+			}
+			continue
+		}
+		if calls == 0 {
+			t.Errorf("%v: HashFunc not used", algo)
+		}
+		again, err := BuildZstdDict(input, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, again) {
+			t.Errorf("%v: output not reproducible with HashFunc", algo)
+		}
+		ratio, err := EstimateRatio(got, input[:100], zstd.SpeedDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ratio > 0.9 {
+			t.Errorf("%v: ratio %.2f with HashFunc", algo, ratio)
+		}
+	}
+}
+
+func TestOptimizeForDecodeMemory(t *testing.T) {
+	input := testSamples(1000, 55)
+	for _, algo := range []Algorithm{AlgoHash, AlgoCover} {
+		o := Options{MaxDictSize: 8192, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault, Algorithm: algo}
+		full, err := BuildZstdDict(input, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.OptimizeForDecodeMemory = true
+		small, segs, err := BuildZstdDictDebug(input, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fullContent, err := ToRawContent(full)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ToRawContent(small)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(content) >= len(fullContent) {
+			t.Fatalf("%v: content not reduced: %d >= %d", algo, len(content), len(fullContent))
+		}
+		if !bytes.HasSuffix(fullContent, content) {
+			t.Errorf("%v: content is not the end of the full content", algo)
+		}
+		size := 0
+		for _, seg := range segs {
+			size += len(seg.Content)
+		}
+		if size != len(content) {
+			t.Errorf("%v: segments are %d bytes, content %d", algo, size, len(content))
+		}
+		fullRatio, err := EstimateRatio(full, input, zstd.SpeedDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ratio, err := EstimateRatio(small, input, zstd.SpeedDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%v: content %d -> %d bytes, ratio %.3f -> %.3f", algo, len(fullContent), len(content), fullRatio, ratio)
+		if ratio > fullRatio*1.25 {
+			t.Errorf("%v: ratio %.3f much worse than %.3f", algo, ratio, fullRatio)
+		}
+
+		o.MinDictSize = len(fullContent) - 100
+		d, err := BuildZstdDict(input, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(d) < o.MinDictSize {
+			t.Errorf("%v: dictionary %d bytes is below MinDictSize %d", algo, len(d), o.MinDictSize)
+		}
+	}
+	_, err := BuildZstdDict(input, Options{MaxDictSize: 8192, HashBytes: 6, OptimizeForDecodeMemory: true, PadToMaxDictSize: true})
+	if err == nil {
+		t.Error("want error with PadToMaxDictSize")
+	}
+}
+
+func TestTimings(t *testing.T) {
+	input := testSamples(1000, 56)
+	for _, algo := range []Algorithm{AlgoHash, AlgoCover, AlgoFastCover} {
+		_, stats, err := BuildZstdDictWithStats(input, Options{MaxDictSize: 2048, HashBytes: 6, ZstdLevel: zstd.SpeedDefault, Algorithm: algo})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tm := stats.Timings
+		if tm.Index <= 0 || tm.Select <= 0 || tm.Entropy <= 0 || tm.Prepare < 0 {
+			t.Errorf("%v: phase not timed: %+v", algo, tm)
+		}
+		if sum := tm.Prepare + tm.Index + tm.Select + tm.Entropy; sum > tm.Total {
+			t.Errorf("%v: phases add up to %v, more than total %v", algo, sum, tm.Total)
+		}
+	}
+}
+
+func TestSplitSamples(t *testing.T) {
+	input := testSamples(1000, 57)
+	train, holdout := SplitSamples(input, 0.2, 1)
+	if len(holdout) != 200 || len(train) != 800 {
+		t.Fatalf("got %d train and %d holdout samples", len(train), len(holdout))
+	}
+	train2, holdout2 := SplitSamples(input, 0.2, 1)
+	if !reflect.DeepEqual(train, train2) || !reflect.DeepEqual(holdout, holdout2) {
+		t.Error("split not deterministic")
+	}
+	_, holdout3 := SplitSamples(input, 0.2, 2)
+	if reflect.DeepEqual(holdout, holdout3) {
+		t.Error("split does not depend on seed")
+	}
+	// Both parts keep the order of the samples, and together contain all samples.
+	var ti, hi int
+	for i, b := range input {
+		switch {
+		case ti < len(train) && &train[ti][0] == &b[0]:
+			ti++
+		case hi < len(holdout) && &holdout[hi][0] == &b[0]:
+			hi++
+		default:
+			t.Fatalf("sample %d not found in order", i)
+		}
+	}
+	for _, f := range []float64{-1, 0, math.NaN()} {
+		if train, holdout := SplitSamples(input, f, 1); len(train) != len(input) || len(holdout) != 0 {
+			t.Errorf("fraction %v: got %d train and %d holdout samples", f, len(train), len(holdout))
+		}
+	}
+	if train, holdout := SplitSamples(input, 2, 1); len(train) != 0 || len(holdout) != len(input) {
+		t.Errorf("fraction 2: got %d train and %d holdout samples", len(train), len(holdout))
+	}
+}
+
+func TestEntropyOnly(t *testing.T) {
+	rng := rand.New(rand.NewSource(59))
+	input := make([][]byte, 1000)
+	for i := range input {
+		b := make([]byte, 40)
+		rng.Read(b)
+		input[i] = []byte(fmt.Sprintf("%x", b))
+	}
+	o := Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 1234, ZstdLevel: zstd.SpeedDefault, EntropyOnly: true}
+	d, stats, err := BuildZstdDictWithStats(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ContentSize != 8 || stats.EntropyTablesSize == 0 {
+		t.Errorf("want 8 bytes of content and entropy tables, got %d bytes of content, %d of tables", stats.ContentSize, stats.EntropyTablesSize)
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderDict(d), zstd.WithEncoderConcurrency(1), zstd.WithAllLitEntropyCompression(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	plain, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithAllLitEntropyCompression(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderDicts(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	var withDict, without int
+	for _, b := range input[:100] {
+		c := enc.EncodeAll(b, nil)
+		got, err := dec.DecodeAll(c, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, b) {
+			t.Fatal("output mismatch")
+		}
+		withDict += len(c)
+		without += len(plain.EncodeAll(b, nil))
+	}
+	if withDict >= without {
+		t.Errorf("entropy only dictionary does not help: %d >= %d bytes", withDict, without)
+	}
+
+	// Required segments are kept.
+	o.RequiredSegments = [][]byte{[]byte("required content")}
+	d, err = BuildZstdDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ToRawContent(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "required content" {
+		t.Errorf("got content %q", content)
+	}
+
+	if _, err := BuildRawDict(input, o); err == nil {
+		t.Error("want error for raw dictionary")
+	}
+}
+
+func TestMaxKmerPerSample(t *testing.T) {
+	rng := rand.New(rand.NewSource(60))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	token := random(64)
+	sep := bytes.Repeat([]byte("-=|=-=|="), 100)
+	var input [][]byte
+	for i := 0; i < 20; i++ {
+		input = append(input, append(random(100), sep...))
+	}
+	for i := 0; i < 200; i++ {
+		input = append(input, append(random(100), token...))
+	}
+	o := Options{MaxDictSize: 64, HashBytes: 6, Algorithm: AlgoFastCover, SegmentSize: 64}
+	d, err := BuildRawDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(d, token[16:48]) {
+		t.Fatal("token selected without MaxKmerPerSample")
+	}
+	o.MaxKmerPerSample = 1
+	d, err = BuildRawDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(d, token[16:48]) {
+		t.Error("token not selected with MaxKmerPerSample")
+	}
+	o.Concurrency = 1
+	d1, err := BuildRawDict(input, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d, d1) {
+		t.Error("output depends on Concurrency")
+	}
+	o.MaxKmerPerSample = -1
+	if _, err := BuildRawDict(input, o); err == nil {
+		t.Error("want error for negative MaxKmerPerSample")
+	}
+}
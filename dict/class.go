@@ -0,0 +1,63 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// BuildZstdDictsByClass will build a Zstandard dictionary for each class of samples.
+// classOf is called with the index of each sample and must return its class.
+// The dictionaries are returned keyed by class.
+//
+// The dictionary ID of each class is derived from the class name,
+// so rebuilding a class keeps its ID. o.ZstdDictID and o.AutoDictID are ignored,
+// unless o.RawContentOnly is set, in which case no IDs are used.
+func BuildZstdDictsByClass(input [][]byte, classOf func(i int) string, o Options) (map[string][]byte, error) {
+	if len(input) == 0 {
+		return nil, ErrNoSamples
+	}
+	classes := make(map[string][][]byte)
+	for i, b := range input {
+		c := classOf(i)
+		classes[c] = append(classes[c], b)
+	}
+	names := make([]string, 0, len(classes))
+	for c := range classes {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+
+	println, _ := o.printers()
+	o.outFormat = formatZstd
+	o.AutoDictID = false
+	o.scratch = &buildScratch{}
+	ids := make(map[uint32]string, len(names))
+	res := make(map[string][]byte, len(names))
+	for _, c := range names {
+		co := o
+		if !o.RawContentOnly {
+			co.ZstdDictID = classDictID(c)
+			if prev, ok := ids[co.ZstdDictID]; ok {
+				return nil, fmt.Errorf("classes %q and %q have the same dictionary ID %d", prev, c, co.ZstdDictID)
+			}
+			ids[co.ZstdDictID] = c
+		}
+		println("Building dictionary for class", c, "from", len(classes[c]), "samples")
+		d, err := buildDict(context.Background(), classes[c], nil, co, nil)
+		if err != nil {
+			return nil, fmt.Errorf("class %q: %w", c, err)
+		}
+		res[c] = d
+	}
+	return res, nil
+}
+
+// classDictID returns the dictionary ID of a class.
+func classDictID(class string) uint32 {
+	return contentDictID([]byte(class))
+}
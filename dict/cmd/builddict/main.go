@@ -22,11 +22,16 @@ var (
 	wantHashBytes  = flag.Int("hash", 6, "Hash bytes match length. Minimum match length.")
 	wantMaxBytes   = flag.Int("max", 32<<10, "Max input length to index per input file")
 	wantOutput     = flag.String("o", "dictionary.bin", "Output name")
-	wantFormat     = flag.String("format", "zstd", `Output type. "zstd" "s2" or "raw"`)
+	wantFormat     = flag.String("format", "zstd", `Output type. "zstd" "s2" "flate" or "raw"`)
+	wantAlgo       = flag.String("algo", "hash", `Content selection algorithm. "hash", "cover" or "fastcover"`)
+	wantSegment    = flag.Int("segment", 0, "Segment size for cover algorithm. Default (0) is 256")
 	wantZstdID     = flag.Uint("dictID", 0, "Zstd dictionary ID. Default (0) will be random")
 	wantZstdCompat = flag.Bool("zcompat", true, "Generate dictionary compatible with zstd 1.5.5 and older")
 	wantZstdLevel  = flag.Int("zlevel", 0, "Zstd compression level. 0-4")
+	wantDedup      = flag.Bool("dedup", false, "Remove duplicate input files")
+	wantThreads    = flag.Int("t", 0, "Number of goroutines used for indexing. Default (0) uses all cores")
 	quiet          = flag.Bool("q", false, "Do not print progress")
+	verbose        = flag.Bool("v", false, "Print details of the selected content")
 )
 
 func main() {
@@ -39,6 +44,22 @@ func main() {
 		ZstdDictID:     uint32(*wantZstdID),
 		ZstdDictCompat: *wantZstdCompat,
 		ZstdLevel:      zstd.EncoderLevel(*wantZstdLevel),
+		SegmentSize:    *wantSegment,
+		Dedup:          *wantDedup,
+		Concurrency:    *wantThreads,
+	}
+	switch *wantAlgo {
+	case "hash":
+		o.Algorithm = dict.AlgoHash
+	case "cover":
+		o.Algorithm = dict.AlgoCover
+	case "fastcover":
+		o.Algorithm = dict.AlgoFastCover
+	default:
+		log.Fatalf("unknown algorithm %q", *wantAlgo)
+	}
+	if *verbose {
+		o.LogLevel = dict.LogDebug
 	}
 	if *wantOutput == "" || *quiet {
 		o.Output = nil
@@ -90,6 +111,8 @@ func main() {
 		out, err = dict.BuildZstdDict(input, o)
 	case "s2":
 		out, err = dict.BuildS2Dict(input, o)
+	case "flate":
+		out, err = dict.BuildFlateDict(input, o)
 	case "raw":
 		out, err = dict.BuildRawDict(input, o)
 	default:
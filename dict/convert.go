@@ -0,0 +1,54 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ToRawContent returns the content of a Zstandard dictionary, without header and entropy tables.
+// The result can be used with zstd.WithEncoderDictRaw and zstd.WithDecoderDictRaw.
+// Dictionaries without the Zstandard magic number are already raw content and are returned as is.
+func ToRawContent(dict []byte) ([]byte, error) {
+	if len(dict) == 0 {
+		return nil, errors.New("empty dictionary")
+	}
+	if !bytes.HasPrefix(dict, zstdDictMagic) {
+		return dict, nil
+	}
+	d, err := zstd.InspectDictionary(dict)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), d.Content()...), nil
+}
+
+// FromRawContent builds a Zstandard dictionary with the provided content.
+// The entropy tables are built by compressing the samples with the content,
+// so samples should be representative of the data compressed with the dictionary.
+// Without samples, use the content as a raw dictionary instead.
+//
+// The options for the dictionary ID, ZstdDictCompat, ZstdLevel, ComputeRepeatOffsets
+// and MaxEntropyTableBytes are used. Options for selecting content are ignored,
+// and RawContentOnly cannot be set.
+func FromRawContent(content []byte, samples [][]byte, o Options) ([]byte, error) {
+	if len(content) < 8 {
+		return nil, errors.New("content must be at least 8 bytes")
+	}
+	if bytes.HasPrefix(content, zstdDictMagic) {
+		return nil, errors.New("content is a Zstandard dictionary")
+	}
+	if o.RawContentOnly {
+		return nil, errors.New("RawContentOnly cannot be used with FromRawContent")
+	}
+	if len(samples) == 0 {
+		return nil, ErrNoSamples
+	}
+	o.outFormat = formatZstd
+	return finishDict(samples, content, nil, o)
+}
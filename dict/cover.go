@@ -0,0 +1,420 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// coverSegment is a range of dmers in the global dmer index.
+type coverSegment struct {
+	sample     int
+	begin, end int
+	score      uint64
+}
+
+// cover contains the state used by the COVER algorithm.
+//
+// All dmer positions of all samples are addressed by a global index,
+// where sample i covers the indexes starts[i] to starts[i+1].
+// Segments never cross sample boundaries.
+type cover struct {
+	samples [][]byte
+	starts  []int
+	d, k    int
+
+	// ids contains the dmer id of each position in the global index.
+	// If nil, ids are hashes of f bits, computed when needed.
+	ids []uint32
+	f   uint8
+	// freqs contains the frequency of each dmer id.
+	freqs []uint32
+	// active counts occurrences of each dmer id in the current window.
+	active []uint32
+	// window contains the ids of the dmers in the current window.
+	window []uint32
+}
+
+// init sets up the global index for the input, reusing memory of s.
+// It returns the number of dmers.
+func (c *cover) init(input [][]byte, d, k int, s *buildScratch) int {
+	*c = cover{window: c.window[:0]}
+	c.samples = input
+	if cap(s.starts) < len(input)+1 {
+		s.starts = make([]int, len(input)+1)
+	}
+	c.starts = s.starts[:len(input)+1]
+	c.d = d
+	c.k = k
+	n := 0
+	for i, b := range input {
+		c.starts[i] = n
+		if len(b) >= d {
+			n += len(b) - d + 1
+		}
+	}
+	c.starts[len(input)] = n
+	return n
+}
+
+// coverDmerBytes is the approximate memory used per dmer by AlgoCover.
+const coverDmerBytes = 8
+
+// newCover indexes all dmers in the input using the specified number of goroutines.
+// The frequency of a dmer is the weighted number of samples containing it.
+// Dmer ids are assigned in order of first occurrence.
+// Progress is reported to p, if non-nil.
+func newCover(ctx context.Context, input [][]byte, weights sampleWeights, d, k int, hash func([]byte) uint32, concurrency int, s *buildScratch, p *progress) (*cover, error) {
+	c := &s.cover
+	c.ids = zeroUint32s(&s.ids, c.init(input, d, k, s))
+
+	// Each shard assigns local ids, which are then mapped to global ids.
+	shards := s.getCoverShards(concurrency)
+	err := runShards(ctx, len(input), concurrency, func(shard, start, end int) error {
+		res := &shards[shard]
+		dense := res.dense
+		lastSeen := res.lastSeen
+		for i, b := range input[start:end] {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			i += start
+			ids := c.ids[c.starts[i]:c.starts[i+1]]
+			w := weights.get(i)
+			for j := range ids {
+				h := hash(b[j:])
+				id, ok := dense[h]
+				if !ok {
+					id = uint32(len(res.hashes))
+					dense[h] = id
+					res.hashes = append(res.hashes, h)
+					res.freqs = append(res.freqs, 0)
+					lastSeen = append(lastSeen, -1)
+				}
+				ids[j] = id
+				// Count each dmer once per sample.
+				if lastSeen[id] != i {
+					lastSeen[id] = i
+					res.freqs[id] += w
+				}
+			}
+			p.add(1)
+		}
+		res.lastSeen = lastSeen
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dense := s.getDense()
+	c.freqs = s.freqs[:0]
+	for shard, res := range shards {
+		remap := zeroUint32s(&s.remap, len(res.hashes))
+		for i, h := range res.hashes {
+			id, ok := dense[h]
+			if !ok {
+				id = uint32(len(c.freqs))
+				dense[h] = id
+				c.freqs = append(c.freqs, 0)
+			}
+			c.freqs[id] += res.freqs[i]
+			remap[i] = id
+		}
+		start, end := shardRange(shard, len(input), concurrency)
+		ids := c.ids[c.starts[start]:c.starts[end]]
+		for i, id := range ids {
+			ids[i] = remap[id]
+		}
+	}
+	s.freqs = c.freqs
+	c.active = zeroUint32s(&s.active, len(c.freqs))
+	return c, nil
+}
+
+// newFastCover counts dmers hashed to f bits in the input using the specified number of goroutines.
+// The frequency of a dmer is the weighted number of times it occurs,
+// where only every accel'th position is counted.
+// If maxPerSample > 0, each sample counts each hash at most maxPerSample times.
+// Progress is reported to p, if non-nil.
+func newFastCover(ctx context.Context, input [][]byte, weights sampleWeights, d, k int, f uint8, accel, maxPerSample, concurrency int, s *buildScratch, p *progress) (*cover, error) {
+	c := &s.cover
+	c.init(input, d, k, s)
+	c.f = f
+	c.freqs = zeroUint32s(&s.freqs, 1<<f)
+	c.active = zeroUint32s(&s.active, 1<<f)
+	err := runShards(ctx, len(input), concurrency, func(shard, start, end int) error {
+		var seen map[uint32]int
+		if maxPerSample > 0 {
+			seen = make(map[uint32]int)
+		}
+		for i, b := range input[start:end] {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			for h := range seen {
+				delete(seen, h)
+			}
+			w := weights.get(start + i)
+			for j := 0; j+d <= len(b); j += accel {
+				h := c.hash(b, j)
+				if seen != nil {
+					if seen[h] >= maxPerSample {
+						continue
+					}
+					seen[h]++
+				}
+				if concurrency > 1 {
+					atomic.AddUint32(&c.freqs[h], w)
+				} else {
+					c.freqs[h] += w
+				}
+			}
+			p.add(1)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// hash returns the f bit hash of the dmer at b[i:].
+func (c *cover) hash(b []byte, i int) uint32 {
+	if c.d == 4 {
+		return hash4x64(load64(b, i), c.f)
+	}
+	return hashLen(load64(b, i), c.f, uint8(c.d))
+}
+
+// dmer returns the id of the dmer at global index i, which must be in sample s.
+func (c *cover) dmer(s, i int) uint32 {
+	if c.ids != nil {
+		return c.ids[i]
+	}
+	return c.hash(c.samples[s], i-c.starts[s])
+}
+
+// load64 loads up to 8 bytes from b at offset i, zero padded.
+func load64(b []byte, i int) uint64 {
+	if len(b)-i >= 8 {
+		return binary.LittleEndian.Uint64(b[i:])
+	}
+	var tmp [8]byte
+	copy(tmp[:], b[i:])
+	return binary.LittleEndian.Uint64(tmp[:])
+}
+
+// sampleAt returns the sample containing the global index idx.
+func (c *cover) sampleAt(idx int) int {
+	return sort.Search(len(c.samples), func(i int) bool {
+		return c.starts[i+1] > idx
+	})
+}
+
+// bytes returns the content of the segment.
+func (c *cover) bytes(s coverSegment) []byte {
+	start := c.starts[s.sample]
+	return c.samples[s.sample][s.begin-start : s.end-start+c.d-1]
+}
+
+// selectSegment returns the best segment in the global index range [begin, end).
+// The frequencies of the dmers in the returned segment are set to 0.
+func (c *cover) selectSegment(begin, end int) coverSegment {
+	var best coverSegment
+	if n := c.k - c.d + 1; len(c.window) != n {
+		if cap(c.window) < n {
+			c.window = make([]uint32, n)
+		}
+		c.window = c.window[:n]
+	}
+	window := c.window
+	for s := c.sampleAt(begin); s < len(c.samples) && c.starts[s] < end; s++ {
+		sBegin, sEnd := c.starts[s], c.starts[s+1]
+		if sBegin < begin {
+			sBegin = begin
+		}
+		if sEnd > end {
+			sEnd = end
+		}
+		var score uint64
+		wBegin, wPos := sBegin, 0
+		for i := sBegin; i < sEnd; i++ {
+			if i-wBegin == len(window) {
+				// Remove the dmer leaving the window.
+				id := window[wPos]
+				c.active[id]--
+				if c.active[id] == 0 {
+					score -= uint64(c.freqs[id])
+				}
+				wBegin++
+			}
+			id := c.dmer(s, i)
+			if c.active[id] == 0 {
+				score += uint64(c.freqs[id])
+			}
+			c.active[id]++
+			window[wPos] = id
+			wPos++
+			if wPos == len(window) {
+				wPos = 0
+			}
+			if score > best.score {
+				best = coverSegment{sample: s, begin: wBegin, end: i + 1, score: score}
+			}
+		}
+		for _, id := range window[:sEnd-wBegin] {
+			c.active[id]--
+		}
+	}
+	if best.score == 0 {
+		return best
+	}
+	// Trim dmers that add no value.
+	for best.begin < best.end && c.freqs[c.dmer(best.sample, best.begin)] == 0 {
+		best.begin++
+	}
+	for best.end > best.begin && c.freqs[c.dmer(best.sample, best.end-1)] == 0 {
+		best.end--
+	}
+	for i := best.begin; i < best.end; i++ {
+		c.freqs[c.dmer(best.sample, i)] = 0
+	}
+	return best
+}
+
+// coverContent returns the dictionary content selected by the COVER or FastCover algorithm.
+//
+// The dmer index is split into epochs, and the best segment of each epoch is added
+// until the dictionary is full. The first selected segments are placed at the end.
+func coverContent(ctx context.Context, input [][]byte, weights sampleWeights, o Options, stats *DictStats) ([]byte, error) {
+	println, _ := o.printers()
+	debugln, debugf := o.debugPrinters()
+	var c *cover
+	var err error
+	if o.MaxMemoryBytes > 0 {
+		// Each dmer of the input needs an id and most likely a map entry.
+		var n int64
+		for _, b := range input {
+			n += int64(len(b))
+		}
+		if o.Algorithm == AlgoCover && n*coverDmerBytes > o.MaxMemoryBytes {
+			println("Input too large for memory limit, using fastcover")
+			o.Algorithm = AlgoFastCover
+		}
+		// FastCover uses two tables of 4 bytes per entry.
+		for o.FastCoverF > 8 && int64(8)<<o.FastCoverF > o.MaxMemoryBytes {
+			o.FastCoverF--
+		}
+	}
+	start := time.Now()
+	if o.Algorithm == AlgoFastCover {
+		c, err = newFastCover(ctx, input, weights, o.HashBytes, o.SegmentSize, uint8(o.FastCoverF), o.FastCoverAccel, o.MaxKmerPerSample, o.concurrency(len(input)), o.scratch, o.progress(len(input)))
+	} else {
+		c, err = newCover(ctx, input, weights, o.HashBytes, o.SegmentSize, o.hasher(), o.concurrency(len(input)), o.scratch, o.progress(len(input)))
+	}
+	if err != nil {
+		return nil, err
+	}
+	stats.Timings.Index += time.Since(start)
+	nDmers := c.starts[len(input)]
+	println("Total dmers:", nDmers, "table size:", len(c.freqs))
+	for i := range input {
+		if c.starts[i+1] > c.starts[i] {
+			stats.SamplesUsed++
+		}
+	}
+	if nDmers == 0 {
+		return nil, ErrSamplesTooSmall
+	}
+
+	// Compute epochs, so each epoch is visited several times.
+	// FastCover visits each epoch once, which makes each epoch smaller.
+	passes := 4
+	if o.Algorithm == AlgoFastCover {
+		passes = 1
+	}
+	nEpochs := o.MaxDictSize / c.k / passes
+	if nEpochs < 1 {
+		nEpochs = 1
+	}
+	epochSize := nDmers / nEpochs
+	if minSize := c.k * 10; epochSize < minSize {
+		epochSize = minSize
+		if epochSize > nDmers {
+			epochSize = nDmers
+		}
+		nEpochs = nDmers / epochSize
+	}
+	maxZeroRun := nEpochs >> 3
+	if maxZeroRun < 10 {
+		maxZeroRun = 10
+	}
+	if maxZeroRun > 100 {
+		maxZeroRun = 100
+	}
+	println("Epochs:", nEpochs, "size:", epochSize)
+
+	dst := make([]byte, o.MaxDictSize)
+	tail := len(dst)
+	selectProgress := o.progress(len(dst))
+	zeroRun := 0
+	for epoch := 0; tail > 0; epoch = (epoch + 1) % nEpochs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if tail < len(dst) && o.budgetExceeded() {
+			println("Time budget exceeded after", len(dst)-tail, "bytes")
+			stats.BudgetExceeded = true
+			break
+		}
+		begin := epoch * epochSize
+		seg := c.selectSegment(begin, begin+epochSize)
+		stats.Candidates++
+		stats.addScore(weights.unscale(seg.score))
+		if seg.score == 0 {
+			zeroRun++
+			if zeroRun >= maxZeroRun {
+				break
+			}
+			continue
+		}
+		zeroRun = 0
+		b := c.bytes(seg)
+		if containedInAny(b, o.RequiredSegments) {
+			continue
+		}
+		if containsAny(b, o.ExcludeSequences) {
+			stats.Excluded++
+			continue
+		}
+		if !frequentEnough(b, input, o.MinSegmentFrequency) {
+			stats.Infrequent++
+			continue
+		}
+		if len(b) > tail {
+			b = b[:tail]
+		}
+		if len(b) < c.d {
+			break
+		}
+		tail -= len(b)
+		selectProgress.add(len(b))
+		copy(dst[tail:], b)
+		stats.Selected++
+		if stats.wantSegments {
+			stats.segments = append(stats.segments, Segment{Content: append([]byte(nil), b...), Score: weights.unscale(seg.score)})
+		}
+		debugf("\rselected %d of %d bytes...", len(dst)-tail, len(dst))
+	}
+	debugln("")
+	selectProgress.finish()
+	return dst[tail:], nil
+}
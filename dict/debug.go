@@ -0,0 +1,44 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+)
+
+// Segment is a part of the dictionary content selected by the builder.
+type Segment struct {
+	// Content of the segment.
+	Content []byte
+
+	// Score is the score of the segment when it was selected.
+	// For AlgoHash this is the number of samples containing the match the segment was built from.
+	// For AlgoCover and AlgoFastCover it is the summed frequency of the k-mers in the segment.
+	// For weighted samples, an average weight counts as 1.
+	Score float64
+
+	// Frequency is the number of samples containing the full content of the segment.
+	Frequency int
+}
+
+// BuildZstdDictDebug will build a Zstandard dictionary from the provided input,
+// and return the segments selected for the content in the order they were selected.
+// The first segments are placed at the end of the content.
+// The last segment may be truncated to fit MaxDictSize.
+//
+// This is intended for debugging and is slower than BuildZstdDict.
+func BuildZstdDictDebug(input [][]byte, o Options) ([]byte, []Segment, error) {
+	stats := DictStats{wantSegments: true}
+	o.outFormat = formatZstd
+	d, err := buildDict(context.Background(), input, nil, o, &stats)
+	if err != nil {
+		return nil, nil, err
+	}
+	segs := stats.segments
+	for i := range segs {
+		segs[i].Frequency = sampleFrequency(segs[i].Content, input, 0)
+	}
+	return d, segs, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"errors"
+)
+
+// Dict is a built dictionary, which can be handled independently of its format.
+type Dict interface {
+	// Content returns the content that compressed data can reference.
+	Content() []byte
+
+	// ID returns the ID compressed data uses to identify the dictionary,
+	// or 0 if there is none.
+	ID() uint32
+
+	// Format returns the name of the format, "zstd" or "flate".
+	Format() string
+}
+
+// ZstdDict is a Zstandard dictionary.
+type ZstdDict struct {
+	b       []byte
+	content []byte
+	id      uint32
+}
+
+// NewZstdDict returns the Zstandard dictionary b, as returned by BuildZstdDict.
+// Dictionaries without the Zstandard magic number are raw content with ID 0.
+// b is referenced, not copied.
+func NewZstdDict(b []byte) (*ZstdDict, error) {
+	if err := Validate(b); err != nil {
+		return nil, err
+	}
+	d, err := InspectDict(b)
+	if err != nil {
+		return nil, err
+	}
+	return &ZstdDict{b: b, content: b[len(b)-d.ContentSize:], id: d.ID}, nil
+}
+
+// Bytes returns the dictionary, as returned by BuildZstdDict.
+func (d *ZstdDict) Bytes() []byte { return d.b }
+
+// Content returns the content of the dictionary, without header and entropy tables.
+func (d *ZstdDict) Content() []byte { return d.content }
+
+// ID returns the dictionary ID, or 0 for raw content.
+func (d *ZstdDict) ID() uint32 { return d.id }
+
+// Format returns "zstd".
+func (d *ZstdDict) Format() string { return "zstd" }
+
+// FlateDict is a deflate preset dictionary.
+type FlateDict struct {
+	b []byte
+}
+
+// NewFlateDict returns the preset dictionary b, as returned by BuildFlateDict.
+// b is referenced, not copied.
+func NewFlateDict(b []byte) (*FlateDict, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty dictionary")
+	}
+	return &FlateDict{b: b}, nil
+}
+
+// Bytes returns the dictionary, as returned by BuildFlateDict.
+func (d *FlateDict) Bytes() []byte { return d.b }
+
+// Content returns the dictionary.
+// Only the last 32KB can be referenced.
+func (d *FlateDict) Content() []byte { return d.b }
+
+// ID returns the Adler-32 checksum of the dictionary,
+// which zlib streams use to identify it. See FlateDictAdler32.
+func (d *FlateDict) ID() uint32 { return FlateDictAdler32(d.b) }
+
+// Format returns "flate".
+func (d *FlateDict) Format() string { return "flate" }
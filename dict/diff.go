@@ -0,0 +1,63 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+// DiffStats describes how the content of two dictionaries differs.
+// Content is shared if it is part of a 6 byte match in the other dictionary, as for DriftScore.
+type DiffStats struct {
+	// SharedA is the number of content bytes of a that are shared with b.
+	SharedA int
+
+	// SharedB is the number of content bytes of b that are shared with a.
+	SharedB int
+
+	// OnlyA is the number of content bytes of a that are not in b.
+	OnlyA int
+
+	// OnlyB is the number of content bytes of b that are not in a.
+	OnlyB int
+
+	// Overlap is the fraction of the content of both dictionaries that is shared.
+	// 1 means the content is the same, possibly reordered, and 0 that nothing is shared.
+	Overlap float64
+
+	// IDA and IDB are the dictionary IDs of a and b. Raw content dictionaries have ID 0.
+	IDA, IDB uint32
+
+	// IDChanged is true if the dictionary IDs differ.
+	IDChanged bool
+}
+
+// DictDiff compares the content of the dictionaries a and b.
+// Both Zstandard and raw dictionaries are accepted.
+//
+// When a dictionary is rebuilt, a high overlap means most matches found with the old
+// dictionary are still found with the new one. A low overlap means the dictionaries
+// should be treated as unrelated.
+func DictDiff(a, b []byte) (DiffStats, error) {
+	var res DiffStats
+	var err error
+	if res.IDA, err = DictID(a); err != nil {
+		return DiffStats{}, err
+	}
+	if res.IDB, err = DictID(b); err != nil {
+		return DiffStats{}, err
+	}
+	res.IDChanged = res.IDA != res.IDB
+	contentA, err := ToRawContent(a)
+	if err != nil {
+		return DiffStats{}, err
+	}
+	contentB, err := ToRawContent(b)
+	if err != nil {
+		return DiffStats{}, err
+	}
+	res.SharedA, _ = coveredBytes(contentB, [][]byte{contentA}, driftHashBytes)
+	res.SharedB, _ = coveredBytes(contentA, [][]byte{contentB}, driftHashBytes)
+	res.OnlyA = len(contentA) - res.SharedA
+	res.OnlyB = len(contentB) - res.SharedB
+	res.Overlap = float64(res.SharedA+res.SharedB) / float64(len(contentA)+len(contentB))
+	return res, nil
+}
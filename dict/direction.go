@@ -0,0 +1,58 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+)
+
+// hashContentBackward returns the content selected by AlgoHash using DirBackward.
+// Extending matches backward is the same as extending them forward in reversed samples.
+func hashContentBackward(ctx context.Context, input [][]byte, weights sampleWeights, o Options, stats *DictStats) ([]byte, error) {
+	reversed := make([][]byte, len(input))
+	for i, b := range input {
+		reversed[i] = reverseBytes(append([]byte(nil), b...))
+	}
+	// Counts of the samples cannot be used for the reversed samples.
+	if o.scratch.counts != nil {
+		s := *o.scratch
+		s.counts = nil
+		o.scratch = &s
+	}
+	content, _, err := hashContent(ctx, reversed, weights, o, stats, true)
+	return content, err
+}
+
+// hashContentBoth returns the content selected by AlgoHash using DirBoth.
+// Content is selected in both directions, and the content with the highest coverage is returned.
+func hashContentBoth(ctx context.Context, input [][]byte, weights sampleWeights, o Options, stats *DictStats) ([]byte, []int, error) {
+	println, _ := o.printers()
+	fwdStats, backStats := *stats, *stats
+	fwd, firstOffsets, err := hashContent(ctx, input, weights, o, &fwdStats, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	back, err := hashContentBackward(ctx, input, weights, o, &backStats)
+	if err != nil {
+		return nil, nil, err
+	}
+	fwdCov := coverage(fwd, input, o.HashBytes)
+	backCov := coverage(back, input, o.HashBytes)
+	println("Coverage forward:", fwdCov, "backward:", backCov)
+	if backCov > fwdCov {
+		*stats = backStats
+		return back, nil, nil
+	}
+	*stats = fwdStats
+	return fwd, firstOffsets, nil
+}
+
+// reverseBytes reverses b in place and returns it.
+func reverseBytes(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
@@ -0,0 +1,131 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// EstimateRatio compresses all samples with and without the Zstandard dictionary
+// and returns the total size with the dictionary divided by the total size without.
+// A value below 1 means the dictionary reduces the size.
+// Dictionaries without the Zstandard magic number are used as raw content.
+// If level is 0, zstd.SpeedBestCompression is used.
+func EstimateRatio(dict []byte, samples [][]byte, level zstd.EncoderLevel) (float64, error) {
+	return EstimateRatioN(dict, samples, level, 0)
+}
+
+// EstimateRatioN is like EstimateRatio, but only compresses n samples selected at random.
+// The selection is deterministic. If n is 0 or at least len(samples), all samples are used.
+func EstimateRatioN(dict []byte, samples [][]byte, level zstd.EncoderLevel, n int) (float64, error) {
+	if len(samples) == 0 {
+		return 0, ErrNoSamples
+	}
+	if n > 0 && n < len(samples) {
+		rng := rand.New(rand.NewSource(1))
+		subset := make([][]byte, n)
+		for i, idx := range rng.Perm(len(samples))[:n] {
+			subset[i] = samples[idx]
+		}
+		samples = subset
+	}
+	with, without, err := compressedSizes(dict, samples, level)
+	if err != nil {
+		return 0, err
+	}
+	if without == 0 {
+		return 0, errors.New("samples compressed to 0 bytes")
+	}
+	return float64(with) / float64(without), nil
+}
+
+// compressedSizes returns the total size of samples compressed with and without dict.
+func compressedSizes(dict []byte, samples [][]byte, level zstd.EncoderLevel) (with, without int, err error) {
+	if level == 0 {
+		level = zstd.SpeedBestCompression
+	}
+	plain, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer plain.Close()
+	withDict, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1), encoderDict(dict))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer withDict.Close()
+	var dst []byte
+	for _, b := range samples {
+		dst = plain.EncodeAll(b, dst[:0])
+		without += len(dst)
+		dst = withDict.EncodeAll(b, dst[:0])
+		with += len(dst)
+	}
+	return with, without, nil
+}
+
+// OutlierSamples compresses all samples with the Zstandard dictionary and returns the indexes
+// of the topN samples with the highest compressed size relative to their size, worst first.
+// Samples that compress badly with the dictionary are often of a kind not represented
+// by the training samples. Empty samples are never returned.
+// Dictionaries without the Zstandard magic number are used as raw content.
+// If level is 0, zstd.SpeedBestCompression is used.
+func OutlierSamples(dict []byte, samples [][]byte, topN int, level zstd.EncoderLevel) ([]int, error) {
+	if len(samples) == 0 {
+		return nil, ErrNoSamples
+	}
+	if topN <= 0 {
+		return nil, fmt.Errorf("topN must be > 0, got %d", topN)
+	}
+	if level == 0 {
+		level = zstd.SpeedBestCompression
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1), encoderDict(dict))
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+	idx := make([]int, 0, len(samples))
+	ratios := make([]float64, len(samples))
+	var dst []byte
+	for i, b := range samples {
+		if len(b) == 0 {
+			continue
+		}
+		dst = enc.EncodeAll(b, dst[:0])
+		ratios[i] = float64(len(dst)) / float64(len(b))
+		idx = append(idx, i)
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return ratios[idx[i]] > ratios[idx[j]]
+	})
+	if len(idx) > topN {
+		idx = idx[:topN]
+	}
+	return idx, nil
+}
+
+// encoderDict returns the encoder option for using dict.
+// Dictionaries without the Zstandard magic number are used as raw content with ID 0.
+func encoderDict(dict []byte) zstd.EOption {
+	if !bytes.HasPrefix(dict, zstdDictMagic) {
+		return zstd.WithEncoderDictRaw(0, dict)
+	}
+	return zstd.WithEncoderDict(dict)
+}
+
+// decoderDict returns the decoder option for using dict, matching encoderDict.
+func decoderDict(dict []byte) zstd.DOption {
+	if !bytes.HasPrefix(dict, zstdDictMagic) {
+		return zstd.WithDecoderDictRaw(0, dict)
+	}
+	return zstd.WithDecoderDicts(dict)
+}
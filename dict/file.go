@@ -0,0 +1,143 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdDictMagic is the magic number of Zstandard dictionaries.
+var zstdDictMagic = []byte{0x37, 0xa4, 0x30, 0xec}
+
+// WriteDictFile writes the dictionary to a file at path.
+// The dictionary is written to a temporary file in the same directory,
+// which is renamed to path when fully written,
+// so path will never contain a partially written dictionary.
+// The file is created with permissions 0644.
+func WriteDictFile(path string, dict []byte) error {
+	return writeFileAtomic(path, dict)
+}
+
+// writeFileAtomic writes b to a temporary file in the same directory as path,
+// and renames it to path when fully written.
+func writeFileAtomic(path string, b []byte) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(b); err != nil {
+		return err
+	}
+	if err = f.Chmod(0o644); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// ReadDictFile reads a dictionary from the file at path.
+// If the file starts with the Zstandard dictionary magic number
+// the dictionary is validated, otherwise it is returned as a raw dictionary.
+// Empty files and legacy Zstandard dictionaries are rejected.
+func ReadDictFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateDict(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// validateDict rejects empty dictionaries and invalid Zstandard dictionaries.
+func validateDict(b []byte) error {
+	if len(b) == 0 {
+		return errors.New("empty dictionary file")
+	}
+	if err := checkLegacy(b); err != nil {
+		return err
+	}
+	if bytes.HasPrefix(b, zstdDictMagic) {
+		if _, err := zstd.InspectDictionary(b); err != nil {
+			return fmt.Errorf("invalid zstd dictionary: %w", err)
+		}
+	}
+	return nil
+}
+
+// checksummedMagic is the magic number of checksummed dictionary files.
+var checksummedMagic = []byte("DCRC")
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksummedHeaderSize is the size of the header of checksummed dictionary files.
+const checksummedHeaderSize = 12
+
+// WriteDictFileChecksummed writes the dictionary to a file at path,
+// with a header containing a checksum, in the same way as WriteDictFile.
+// Use ReadDictFileChecksummed to read the file.
+//
+// The file consists of a 12 byte header followed by the dictionary:
+//
+//	magic    4 bytes "DCRC"
+//	length   4 bytes little endian length of the dictionary
+//	checksum 4 bytes little endian CRC-32 (Castagnoli) of the dictionary
+//	dict     length bytes
+func WriteDictFileChecksummed(path string, dict []byte) error {
+	if uint64(len(dict)) > 1<<32-1 {
+		return fmt.Errorf("dictionary of size %d too large", len(dict))
+	}
+	b := make([]byte, checksummedHeaderSize, checksummedHeaderSize+len(dict))
+	copy(b, checksummedMagic)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(dict)))
+	binary.LittleEndian.PutUint32(b[8:], crc32.Checksum(dict, castagnoliTable))
+	b = append(b, dict...)
+	return writeFileAtomic(path, b)
+}
+
+// ReadDictFileChecksummed reads a dictionary written by WriteDictFileChecksummed.
+// If the header is invalid, or the length or checksum doesn't match,
+// an error wrapping ErrDictCorrupt is returned.
+// The dictionary is validated like ReadDictFile.
+func ReadDictFileChecksummed(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < checksummedHeaderSize || !bytes.HasPrefix(b, checksummedMagic) {
+		return nil, fmt.Errorf("%w: invalid header", ErrDictCorrupt)
+	}
+	dict := b[checksummedHeaderSize:]
+	if n := binary.LittleEndian.Uint32(b[4:]); uint64(n) != uint64(len(dict)) {
+		return nil, fmt.Errorf("%w: length is %d, header says %d", ErrDictCorrupt, len(dict), n)
+	}
+	if crc := crc32.Checksum(dict, castagnoliTable); crc != binary.LittleEndian.Uint32(b[8:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrDictCorrupt)
+	}
+	if err := validateDict(dict); err != nil {
+		return nil, err
+	}
+	return dict, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+)
+
+// autoHashBytes are the HashBytes values tried by Options.AutoHashBytes.
+var autoHashBytes = []int{4, 5, 6, 7, 8}
+
+// chooseHashBytes builds a Zstandard dictionary for each value in autoHashBytes
+// from a training part of input, and returns the value that compresses
+// the holdout part of input the best.
+// Candidates are built concurrently, using up to o.Concurrency goroutines in total.
+func chooseHashBytes(ctx context.Context, input [][]byte, weights []float64, o Options) (int, error) {
+	println, _ := o.printers()
+	train, trainW, holdout := splitHoldout(input, weights)
+	o.AutoHashBytes = false
+	o.VerifyBenefit = false
+	o.Output = nil
+	o.Progress = nil
+	o.outFormat = formatZstd
+	o.RawContentOnly = false
+	o.MaxEntropyTableBytes = 0
+	o.AdaptiveEntropy = false
+	// Use a fixed ID, so all candidates have the same frame overhead.
+	o.ZstdDictID = 1
+	o.scratch = nil
+	// Rand is not safe for concurrent use.
+	o.Rand = nil
+
+	sizes := make([]int, len(autoHashBytes))
+	errs := make([]error, len(autoHashBytes))
+	shards := o.concurrency(len(autoHashBytes))
+	if o.Concurrency = o.concurrency(len(train)) / shards; o.Concurrency < 1 {
+		o.Concurrency = 1
+	}
+	err := runShards(ctx, len(autoHashBytes), shards, func(shard, start, end int) error {
+		for i := start; i < end; i++ {
+			co := o
+			co.HashBytes = autoHashBytes[i]
+			if co.SegmentSize != 0 && co.SegmentSize < co.HashBytes {
+				co.SegmentSize = co.HashBytes
+			}
+			dict, err := buildDict(ctx, train, trainW, co, nil)
+			if err == nil {
+				sizes[i], _, err = compressedSizes(dict, holdout, o.ZstdLevel)
+			}
+			errs[i] = err
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	best := -1
+	for i, h := range autoHashBytes {
+		if errs[i] != nil {
+			println("HashBytes", h, "failed:", errs[i])
+			continue
+		}
+		println("HashBytes", h, "compressed holdout size:", sizes[i])
+		if best < 0 || sizes[i] < sizes[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0, errs[0]
+	}
+	return autoHashBytes[best], nil
+}
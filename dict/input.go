@@ -0,0 +1,296 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// BuildZstdDictFromReader will build a Zstandard dictionary from samples read from r.
+//
+// The stream must consist of records, each a 4 byte big endian length
+// followed by that many bytes of sample data.
+// The stream must end after a complete record.
+//
+// Since dictionary content is copied from the samples, samples are kept in memory,
+// after MinSampleSize and MaxSampleSize are applied.
+// If Options.MaxSamples or Options.MaxMemoryBytes is set, a random selection of samples
+// within these limits is kept while reading, using Seed or Rand.
+// Otherwise all samples are added to a Trainer as they are read.
+func BuildZstdDictFromReader(r io.Reader, o Options) ([]byte, error) {
+	s, err := newStreamSamples(o)
+	if err != nil {
+		return nil, err
+	}
+	if err := readSamples(r, s.add); err != nil {
+		return nil, err
+	}
+	return s.finish()
+}
+
+// streamSamples collects samples that are read one at a time.
+// If the options limit the samples, a random selection is kept in a reservoir,
+// otherwise samples are added to a Trainer.
+type streamSamples struct {
+	o   Options
+	t   *Trainer
+	res *sampleReservoir
+}
+
+// newStreamSamples returns a streamSamples for building with o.
+// An error is returned if o is invalid.
+func newStreamSamples(o Options) (*streamSamples, error) {
+	t := NewTrainer(o)
+	if t.err != nil {
+		return nil, t.err
+	}
+	s := &streamSamples{o: o}
+	if o.MaxSamples > 0 || o.MaxMemoryBytes > 0 {
+		s.res = &sampleReservoir{max: o.MaxSamples, maxBytes: o.MaxMemoryBytes, rng: o.rand()}
+		s.o.MaxSamples = 0
+		return s, nil
+	}
+	s.t = t
+	return s, nil
+}
+
+// add adds a sample. The sample is copied, so the caller may reuse it.
+func (s *streamSamples) add(b []byte) {
+	if s.res == nil {
+		s.t.Add(b)
+		return
+	}
+	if len(b) < s.o.MinSampleSize {
+		return
+	}
+	if s.o.MaxSampleSize > 0 && len(b) > s.o.MaxSampleSize {
+		b = b[:s.o.MaxSampleSize]
+	}
+	s.res.add(b)
+}
+
+// finish builds the dictionary from the samples added.
+func (s *streamSamples) finish() ([]byte, error) {
+	if s.res == nil {
+		return s.t.Finish()
+	}
+	return BuildZstdDict(s.res.result(), s.o)
+}
+
+// BuildZstdDictFromOffsets will build a Zstandard dictionary from samples stored in buf.
+// offsets contains the start of each sample, and each sample ends where the next begins.
+// The last sample ends at the end of buf.
+// Offsets must be increasing and within buf. Samples are not copied.
+func BuildZstdDictFromOffsets(buf []byte, offsets []int, o Options) ([]byte, error) {
+	input, err := splitOffsets(buf, offsets)
+	if err != nil {
+		return nil, err
+	}
+	return BuildZstdDict(input, o)
+}
+
+// splitOffsets returns the samples of buf starting at offsets.
+func splitOffsets(buf []byte, offsets []int) ([][]byte, error) {
+	for i, start := range offsets {
+		if start < 0 || start > len(buf) {
+			return nil, fmt.Errorf("offset %d of sample %d is outside buffer of %d bytes", start, i, len(buf))
+		}
+		if i > 0 && start < offsets[i-1] {
+			return nil, fmt.Errorf("offset %d of sample %d is before previous offset %d", start, i, offsets[i-1])
+		}
+	}
+	input := make([][]byte, len(offsets))
+	for i, start := range offsets {
+		end := len(buf)
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+		// Limit capacity, so samples cannot overwrite each other.
+		input[i] = buf[start:end:end]
+	}
+	return input, nil
+}
+
+// readSamples reads length prefixed samples from r until EOF, and calls fn with each sample.
+// The sample is only valid until fn returns.
+func readSamples(r io.Reader, fn func(b []byte)) error {
+	var hdr [4]byte
+	var buf bytes.Buffer
+	for i := 0; ; i++ {
+		_, err := io.ReadFull(r, hdr[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading sample %d length: %w", i, err)
+		}
+		n := int64(binary.BigEndian.Uint32(hdr[:]))
+		// Grow as data is read, so a corrupt length doesn't cause a huge allocation.
+		buf.Reset()
+		_, err = io.CopyN(&buf, r, n)
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return fmt.Errorf("reading sample %d: %w", i, err)
+		}
+		fn(buf.Bytes())
+	}
+}
+
+// BuildZstdDictFromTar will build a Zstandard dictionary using each regular file
+// in the tar archive read from r as a sample.
+// Directories, links and other irregular entries are skipped.
+// All samples are kept in memory while the dictionary is built.
+func BuildZstdDictFromTar(r io.Reader, o Options) ([]byte, error) {
+	input, err := readTar(r)
+	if err != nil {
+		return nil, err
+	}
+	return BuildZstdDict(input, o)
+}
+
+// readTar returns the content of all regular files in the tar archive read from r.
+func readTar(r io.Reader) ([][]byte, error) {
+	var input [][]byte
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return input, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", hdr.Name, err)
+		}
+		input = append(input, b)
+	}
+}
+
+// compressedBatch is the number of samples decompressed by each goroutine
+// in BuildZstdDictFromCompressed before they are added.
+const compressedBatch = 64
+
+// BuildZstdDictFromCompressed will build a Zstandard dictionary from samples that are
+// each compressed as Zstandard frames without a dictionary.
+//
+// Samples are decompressed in batches by Options.Concurrency goroutines,
+// and each batch is added in the order of samples, so the output does not depend on the concurrency.
+// If Options.MaxSampleSize is set, decompression of each sample stops at that size,
+// so only the part of each sample that is used is decompressed.
+//
+// Samples are kept in memory as for BuildZstdDictFromReader.
+// Set Options.MaxMemoryBytes or Options.MaxSamples to keep only a random selection
+// of the decompressed samples within these limits.
+// In addition, up to 64 samples per goroutine are buffered while decompressing.
+func BuildZstdDictFromCompressed(samples [][]byte, o Options) ([]byte, error) {
+	s, err := newStreamSamples(o)
+	if err != nil {
+		return nil, err
+	}
+	workers := o.concurrency(len(samples))
+	decs := make([]*zstd.Decoder, workers)
+	for i := range decs {
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		decs[i] = dec
+	}
+	decoded := make([][]byte, workers*compressedBatch)
+	for start := 0; start < len(samples); start += len(decoded) {
+		batch := samples[start:]
+		if len(batch) > len(decoded) {
+			batch = batch[:len(decoded)]
+		}
+		err := runShards(context.Background(), len(batch), workers, func(shard, from, to int) error {
+			for i := from; i < to; i++ {
+				var err error
+				decoded[i], err = decompressSample(decs[shard], batch[i], decoded[i][:0], o.MaxSampleSize)
+				if err != nil {
+					return fmt.Errorf("sample %d: %w", start+i, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range decoded[:len(batch)] {
+			s.add(b)
+		}
+	}
+	return s.finish()
+}
+
+// decompressSample decompresses b with dec, appending to dst.
+// If maxSize > 0, at most maxSize bytes are read.
+func decompressSample(dec *zstd.Decoder, b, dst []byte, maxSize int) ([]byte, error) {
+	if err := dec.Reset(bytes.NewReader(b)); err != nil {
+		return dst, err
+	}
+	var r io.Reader = dec
+	if maxSize > 0 {
+		r = io.LimitReader(dec, int64(maxSize))
+	}
+	buf := bytes.NewBuffer(dst)
+	_, err := buf.ReadFrom(r)
+	return buf.Bytes(), err
+}
+
+// BuildZstdDictFromDir will build a Zstandard dictionary using each regular file in dir as a sample.
+// Subdirectories are only read if Options.Recursive is set.
+// Symlinks and other irregular files are skipped.
+func BuildZstdDictFromDir(dir string, o Options) ([]byte, error) {
+	input, err := readDir(dir, o.Recursive)
+	if err != nil {
+		return nil, err
+	}
+	return BuildZstdDict(input, o)
+}
+
+// readDir returns the content of all regular files in dir in lexical order.
+func readDir(dir string, recursive bool) ([][]byte, error) {
+	var input [][]byte
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		input = append(input, b)
+		return nil
+	})
+	return input, err
+}
@@ -0,0 +1,124 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DictInfo contains information about a dictionary.
+type DictInfo struct {
+	// ID is the Zstandard dictionary ID. 0 for raw dictionaries.
+	ID uint32
+
+	// HasEntropyTables is true if the dictionary contains entropy tables.
+	HasEntropyTables bool
+
+	// ContentSize is the size of the content used for back-references.
+	ContentSize int
+
+	// Raw is true if the dictionary is raw content without a header.
+	Raw bool
+}
+
+// legacyDictMagics contains the magic numbers of dictionaries
+// from Zstandard versions before v0.7, which used a different layout.
+var legacyDictMagics = map[uint32]string{
+	0xEC30A435: "v0.5",
+	0xEC30A436: "v0.6",
+}
+
+// checkLegacy returns an error wrapping ErrLegacyDict if dict starts with a legacy magic number.
+func checkLegacy(dict []byte) error {
+	if len(dict) < 4 {
+		return nil
+	}
+	if v, ok := legacyDictMagics[binary.LittleEndian.Uint32(dict)]; ok {
+		return fmt.Errorf("%w: Zstandard %s", ErrLegacyDict, v)
+	}
+	return nil
+}
+
+// InspectDict returns information about a dictionary.
+// Dictionaries starting with the Zstandard dictionary magic number are parsed,
+// and an error is returned if they are invalid.
+// Dictionaries in the format of Zstandard before v0.7 return an error wrapping ErrLegacyDict.
+// Other dictionaries are reported as raw content.
+// Dictionaries too short to contain the magic number return an error.
+func InspectDict(dict []byte) (DictInfo, error) {
+	if len(dict) < len(zstdDictMagic) {
+		return DictInfo{}, fmt.Errorf("dictionary too short: %d bytes", len(dict))
+	}
+	if err := checkLegacy(dict); err != nil {
+		return DictInfo{}, err
+	}
+	if !bytes.HasPrefix(dict, zstdDictMagic) {
+		return DictInfo{ContentSize: len(dict), Raw: true}, nil
+	}
+	d, err := zstd.InspectDictionary(dict)
+	if err != nil {
+		return DictInfo{}, err
+	}
+	return DictInfo{
+		ID:               d.ID(),
+		HasEntropyTables: true,
+		ContentSize:      d.ContentSize(),
+	}, nil
+}
+
+// DictID returns the dictionary ID of a Zstandard dictionary.
+// Only the header is parsed, so the rest of the dictionary is not validated.
+// Raw content dictionaries return 0.
+// Dictionaries in the format of Zstandard before v0.7 return an error wrapping ErrLegacyDict.
+func DictID(dict []byte) (uint32, error) {
+	if len(dict) == 0 {
+		return 0, errors.New("empty dictionary")
+	}
+	if err := checkLegacy(dict); err != nil {
+		return 0, err
+	}
+	if !bytes.HasPrefix(dict, zstdDictMagic) {
+		return 0, nil
+	}
+	if len(dict) < 8 {
+		return 0, errors.New("dictionary header truncated")
+	}
+	return binary.LittleEndian.Uint32(dict[4:8]), nil
+}
+
+// Validate checks that dict is a structurally sound dictionary,
+// and returns an error describing the first problem found.
+//
+// Zstandard dictionaries must have a complete header, a non-zero ID,
+// valid entropy tables, and repeat offsets within the content.
+// Legacy Zstandard dictionaries return an error wrapping ErrLegacyDict.
+// Dictionaries without the Zstandard magic number are raw content,
+// which is valid if not empty.
+func Validate(dict []byte) error {
+	if len(dict) == 0 {
+		return errors.New("empty dictionary")
+	}
+	if err := checkLegacy(dict); err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(dict, zstdDictMagic) {
+		return nil
+	}
+	if len(dict) < 8 {
+		return fmt.Errorf("dictionary header truncated: %d bytes", len(dict))
+	}
+	if binary.LittleEndian.Uint32(dict[4:8]) == 0 {
+		return errors.New("dictionary ID is 0, which is reserved for frames without a dictionary")
+	}
+	if _, err := zstd.InspectDictionary(dict); err != nil {
+		return fmt.Errorf("invalid entropy tables or repeat offsets: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// manifestRatioSamples is the maximum number of samples compressed for Manifest.Ratio.
+const manifestRatioSamples = 1000
+
+// Manifest describes how a dictionary was built.
+// It can be stored next to the dictionary using encoding/json.
+type Manifest struct {
+	// DictID is the Zstandard dictionary ID, or 0 if the dictionary is raw content.
+	DictID uint32 `json:"dict_id"`
+
+	// Size is the size of the dictionary in bytes.
+	Size int `json:"size"`
+
+	// ContentSize is the size of the dictionary content in bytes.
+	ContentSize int `json:"content_size"`
+
+	// Created is the time the build finished.
+	Created time.Time `json:"created"`
+
+	// BuildTime is the time the build took.
+	BuildTime time.Duration `json:"build_time_ns"`
+
+	// Samples is the number of samples the dictionary was built from.
+	Samples int `json:"samples"`
+
+	// Algorithm is the content selection algorithm.
+	Algorithm string `json:"algorithm"`
+
+	// HashBytes is the HashBytes used.
+	HashBytes int `json:"hash_bytes"`
+
+	// ZstdLevel is the name of the encoder level the entropy tables were built for,
+	// as returned by zstd.EncoderLevel.String.
+	ZstdLevel string `json:"zstd_level"`
+
+	// Ratio is the compressed size of samples with the dictionary
+	// divided by the size without, as returned by EstimateRatio.
+	// Up to 1000 of the training samples are compressed,
+	// so the ratio may be better than for new data.
+	Ratio float64 `json:"ratio"`
+}
+
+// BuildZstdDictWithManifest will build a Zstandard dictionary from the provided input,
+// and return a Manifest describing the build.
+func BuildZstdDictWithManifest(input [][]byte, o Options) ([]byte, Manifest, error) {
+	start := time.Now()
+	var stats DictStats
+	o.outFormat = formatZstd
+	d, err := buildDict(context.Background(), input, nil, o, &stats)
+	if err != nil {
+		return nil, Manifest{}, err
+	}
+	m := Manifest{
+		Size:        len(d),
+		ContentSize: stats.ContentSize,
+		Created:     time.Now(),
+		Samples:     stats.Samples,
+		Algorithm:   o.Algorithm.String(),
+		HashBytes:   stats.HashBytes,
+		ZstdLevel:   stats.ZstdLevel.String(),
+	}
+	m.BuildTime = m.Created.Sub(start)
+	m.DictID, err = DictID(d)
+	if err != nil {
+		return nil, Manifest{}, err
+	}
+	m.Ratio, err = EstimateRatioN(d, input, o.ZstdLevel, manifestRatioSamples)
+	if err != nil {
+		return nil, Manifest{}, err
+	}
+	return d, m, nil
+}
+
+// CheckLevelMatch returns whether the dictionary will be used at the encoder level it was built for.
+// Entropy tables are built by compressing the samples at a specific level,
+// so other levels may compress worse than expected.
+//
+// The level is not stored in the dictionary, so the Manifest returned when
+// the dictionary was built must be supplied. An error is returned if the manifest
+// does not describe the dictionary, or does not contain a valid level.
+func CheckLevelMatch(dict []byte, m Manifest, level zstd.EncoderLevel) (bool, error) {
+	id, err := DictID(dict)
+	if err != nil {
+		return false, err
+	}
+	if id != m.DictID || len(dict) != m.Size {
+		return false, fmt.Errorf("manifest describes dictionary ID %d of %d bytes, got ID %d of %d bytes", m.DictID, m.Size, id, len(dict))
+	}
+	ok, built := zstd.EncoderLevelFromString(m.ZstdLevel)
+	if !ok {
+		return false, fmt.Errorf("manifest has unknown zstd level %q", m.ZstdLevel)
+	}
+	return built == level, nil
+}
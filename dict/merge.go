@@ -0,0 +1,88 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// MergeZstdDicts will build a Zstandard dictionary from the content of several Zstandard dictionaries.
+//
+// If the combined content fits within MaxDictSize it is concatenated,
+// with the content of the first dictionary placed last, where matches are cheapest.
+// Otherwise the content of the dictionaries is used as samples for selecting new content,
+// for which AlgoCover is recommended.
+// Entropy tables are rebuilt by compressing the samples with the merged content,
+// so samples should be representative of the data of all dictionaries.
+// The dictionary ID is taken from ZstdDictID, or generated if 0.
+func MergeZstdDicts(dicts [][]byte, samples [][]byte, o Options) ([]byte, error) {
+	if len(dicts) == 0 {
+		return nil, fmt.Errorf("no dictionaries provided")
+	}
+	if len(samples) == 0 {
+		return nil, ErrNoSamples
+	}
+	contents := make([][]byte, len(dicts))
+	total := 0
+	for i, d := range dicts {
+		info, err := zstd.InspectDictionary(d)
+		if err != nil {
+			return nil, fmt.Errorf("dictionary %d: %w", i, err)
+		}
+		contents[i] = info.Content()
+		total += len(contents[i])
+	}
+
+	var content []byte
+	if total <= o.MaxDictSize {
+		content = make([]byte, 0, total)
+		for i := range contents {
+			content = append(content, contents[len(contents)-i-1]...)
+		}
+	} else {
+		raw := o
+		raw.outFormat = formatRaw
+		var err error
+		content, err = buildDict(context.Background(), contents, nil, raw, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	o.outFormat = formatZstd
+	return finishDict(samples, content, nil, o)
+}
+
+// RefineZstdDict will build a Zstandard dictionary from new samples,
+// preferring content of the existing Zstandard dictionary.
+//
+// The content of the existing dictionary is added as a sample with the same
+// weight as all new samples combined, so content that is still common
+// in the new samples is kept, while content no longer seen is replaced.
+// When the new samples resemble the samples the existing dictionary was built from,
+// the result will mostly contain the same content.
+//
+// A new dictionary ID is used unless ZstdDictID is set.
+func RefineZstdDict(existing []byte, input [][]byte, o Options) ([]byte, error) {
+	if len(input) == 0 {
+		return nil, ErrNoSamples
+	}
+	info, err := zstd.InspectDictionary(existing)
+	if err != nil {
+		return nil, fmt.Errorf("existing dictionary: %w", err)
+	}
+	samples := make([][]byte, 0, len(input)+1)
+	samples = append(samples, input...)
+	samples = append(samples, info.Content())
+	weights := make([]float64, len(samples))
+	for i := range input {
+		weights[i] = 1
+	}
+	weights[len(input)] = float64(len(input))
+	o.outFormat = formatZstd
+	return buildDict(context.Background(), samples, weights, o, nil)
+}
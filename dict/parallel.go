@@ -0,0 +1,62 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// concurrency returns the number of goroutines to use for n samples.
+func (o Options) concurrency(n int) int {
+	c := o.Concurrency
+	if c <= 0 {
+		c = runtime.GOMAXPROCS(0)
+	}
+	if c > n {
+		c = n
+	}
+	if c < 1 {
+		c = 1
+	}
+	return c
+}
+
+// runShards splits n samples into shards of consecutive samples and calls fn
+// for each shard on a separate goroutine.
+// The shard index, and the first and last+1 sample of the shard is provided.
+// runShards returns when all calls have returned.
+// The first error returned by fn or ctx.Err() is returned.
+func runShards(ctx context.Context, n, shards int, fn func(shard, start, end int) error) error {
+	if shards <= 1 {
+		if err := fn(0, 0, n); err != nil {
+			return err
+		}
+		return ctx.Err()
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, shards)
+	for i := 0; i < shards; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start, end := shardRange(i, n, shards)
+			errs[i] = fn(i, start, end)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// shardRange returns the samples of shard i when splitting n samples into shards.
+func shardRange(i, n, shards int) (start, end int) {
+	return i * n / shards, (i + 1) * n / shards
+}
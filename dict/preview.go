@@ -0,0 +1,56 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"fmt"
+)
+
+// BuildZstdDictPreview will build a small Zstandard dictionary from only the topN
+// highest ranked segments, and return the segments in the order they were ranked.
+// Segments are ranked by building with o, and the dictionary content
+// is then limited to the topN segments, regardless of MaxDictSize.
+// Fewer segments are returned if the content at MaxDictSize holds fewer.
+// Required segments are ranked first.
+//
+// This is intended for inspecting what the builder selects.
+// The dictionary is valid, but will compress worse than one of full size.
+func BuildZstdDictPreview(input [][]byte, topN int, o Options) ([]byte, []Segment, error) {
+	if topN < 1 {
+		return nil, nil, fmt.Errorf("topN must be at least 1, got %d", topN)
+	}
+	o.outFormat = formatZstd
+	stats := DictStats{wantSegments: true}
+	input, w, holdout, err := prepareSamples(input, nil, &o, &stats)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, firstOffsets, err := selectContent(context.Background(), input, w, o, &stats)
+	if err != nil {
+		return nil, nil, err
+	}
+	segs := stats.segments
+	if len(segs) > topN {
+		segs = segs[:topN]
+	}
+	size := 0
+	for _, seg := range segs {
+		size += len(seg.Content)
+	}
+	if size < 8 {
+		return nil, nil, fmt.Errorf("top %d segments are %d bytes, need at least 8", topN, size)
+	}
+	o.MaxDictSize = size
+	o.PadToMaxDictSize = false
+	d, err := finishChecked(input, holdout, segmentsContent(segs, size), firstOffsets, o, &stats)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range segs {
+		segs[i].Frequency = sampleFrequency(segs[i].Content, input, 0)
+	}
+	return d, segs, nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// progress reports progress of a build step to Options.Progress.
+// Progress is reported at most once for every 1% and when the step is done.
+// A nil progress reports nothing.
+type progress struct {
+	fn    func(done, total int)
+	total int64
+	step  int64
+	done  int64
+	next  int64
+
+	mu       sync.Mutex
+	reported int64
+}
+
+// progress returns a progress reporter for a step of total units,
+// or nil if o.Progress is not set.
+func (o Options) progress(total int) *progress {
+	if o.Progress == nil || total <= 0 {
+		return nil
+	}
+	// Round up, so there are at most 100 reports.
+	step := (int64(total) + 99) / 100
+	return &progress{fn: o.Progress, total: int64(total), step: step, next: step}
+}
+
+// add adds n done units. It is safe for concurrent use.
+func (p *progress) add(n int) {
+	if p == nil {
+		return
+	}
+	done := atomic.AddInt64(&p.done, int64(n))
+	if done < atomic.LoadInt64(&p.next) && done < p.total {
+		return
+	}
+	p.report(done)
+}
+
+// finish reports the step as done.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	p.report(p.total)
+}
+
+// report calls the callback with done, unless the same or more was already reported.
+func (p *progress) report(done int64) {
+	if done > p.total {
+		done = p.total
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if done <= p.reported {
+		return
+	}
+	p.reported = done
+	atomic.StoreInt64(&p.next, done+p.step)
+	p.fn(int(done), int(p.total))
+}
@@ -0,0 +1,189 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"bytes"
+	"container/heap"
+	"hash/maphash"
+	"math/rand"
+	"sort"
+)
+
+// dedupSamples removes samples that are identical to an earlier sample.
+// If weights is non-nil, the weights of removed samples are added to the kept sample.
+// The order of the remaining samples is preserved.
+func dedupSamples(input [][]byte, weights []float64) ([][]byte, []float64) {
+	seed := maphash.MakeSeed()
+	seen := make(map[uint64][]int, len(input))
+	resIn := make([][]byte, 0, len(input))
+	var resW []float64
+	if weights != nil {
+		resW = make([]float64, 0, len(input))
+	}
+	for i, b := range input {
+		h := maphash.Bytes(seed, b)
+		dupe := -1
+		for _, idx := range seen[h] {
+			if bytes.Equal(resIn[idx], b) {
+				dupe = idx
+				break
+			}
+		}
+		if dupe >= 0 {
+			if weights != nil {
+				resW[dupe] += weights[i]
+			}
+			continue
+		}
+		seen[h] = append(seen[h], len(resIn))
+		resIn = append(resIn, b)
+		if weights != nil {
+			resW = append(resW, weights[i])
+		}
+	}
+	return resIn, resW
+}
+
+// truncateSamples returns input with samples longer than maxSize truncated.
+// The number of truncated samples is added to stats.
+func truncateSamples(input [][]byte, maxSize int, stats *DictStats) [][]byte {
+	var res [][]byte
+	for i, b := range input {
+		if len(b) <= maxSize {
+			continue
+		}
+		if res == nil {
+			res = make([][]byte, len(input))
+			copy(res, input)
+		}
+		res[i] = b[:maxSize]
+		stats.Truncated++
+	}
+	if res == nil {
+		return input
+	}
+	return res
+}
+
+// dropSmallSamples returns input without samples shorter than minSize.
+// If weights is non-nil, the weights of removed samples are removed as well.
+// The number of removed samples is added to stats.
+func dropSmallSamples(input [][]byte, weights []float64, minSize int, stats *DictStats) ([][]byte, []float64) {
+	resIn := make([][]byte, 0, len(input))
+	var resW []float64
+	if weights != nil {
+		resW = make([]float64, 0, len(input))
+	}
+	for i, b := range input {
+		if len(b) < minSize {
+			stats.TooSmall++
+			continue
+		}
+		resIn = append(resIn, b)
+		if weights != nil {
+			resW = append(resW, weights[i])
+		}
+	}
+	return resIn, resW
+}
+
+// selectSamples returns up to maxSamples samples selected at random,
+// with their weights if non-nil. If maxSamples is 0, all samples are selected.
+// If shuffle is false, the selected samples keep their order.
+func selectSamples(input [][]byte, weights []float64, maxSamples int, shuffle bool, rng *rand.Rand) ([][]byte, []float64) {
+	idx := rng.Perm(len(input))
+	if maxSamples > 0 && maxSamples < len(idx) {
+		idx = idx[:maxSamples]
+	}
+	if !shuffle {
+		sort.Ints(idx)
+	}
+	resIn := make([][]byte, len(idx))
+	var resW []float64
+	if weights != nil {
+		resW = make([]float64, len(idx))
+	}
+	for i, j := range idx {
+		resIn[i] = input[j]
+		if weights != nil {
+			resW[i] = weights[j]
+		}
+	}
+	return resIn, resW
+}
+
+// sampleReservoir keeps a random selection of samples from a stream of samples of unknown length.
+// Each sample is given a random key, and the samples with the lowest keys are kept,
+// up to max samples and maxBytes bytes, if > 0.
+// Samples longer than maxBytes are skipped.
+// Samples are only copied when there is room for them,
+// so no more than maxBytes of samples are kept at any time.
+type sampleReservoir struct {
+	max      int
+	maxBytes int64
+	rng      *rand.Rand
+	seen     int
+	bytes    int64
+	samples  reservoirHeap
+}
+
+// reservoirSample is a sample kept by a sampleReservoir.
+type reservoirSample struct {
+	b   []byte
+	key uint64
+	// index is the position of the sample in the stream.
+	index int
+}
+
+// reservoirHeap is a max-heap of samples ordered by key.
+type reservoirHeap []reservoirSample
+
+func (h reservoirHeap) Len() int            { return len(h) }
+func (h reservoirHeap) Less(i, j int) bool  { return h[i].key > h[j].key }
+func (h reservoirHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *reservoirHeap) Push(x interface{}) { *h = append(*h, x.(reservoirSample)) }
+func (h *reservoirHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// add offers a sample to the reservoir. The sample is copied if it is kept.
+func (r *sampleReservoir) add(b []byte) {
+	r.seen++
+	if r.maxBytes > 0 && int64(len(b)) > r.maxBytes {
+		return
+	}
+	s := reservoirSample{key: r.rng.Uint64(), index: r.seen - 1}
+	// Remove samples with higher keys until there is room.
+	for r.full(len(b)) && len(r.samples) > 0 && r.samples[0].key > s.key {
+		old := heap.Pop(&r.samples).(reservoirSample)
+		r.bytes -= int64(len(old.b))
+	}
+	if r.full(len(b)) {
+		return
+	}
+	s.b = append([]byte(nil), b...)
+	r.bytes += int64(len(b))
+	heap.Push(&r.samples, s)
+}
+
+// full returns whether a sample of n bytes does not fit in the reservoir.
+func (r *sampleReservoir) full(n int) bool {
+	return (r.max > 0 && len(r.samples) >= r.max) || (r.maxBytes > 0 && r.bytes+int64(n) > r.maxBytes)
+}
+
+// result returns the kept samples in stream order.
+func (r *sampleReservoir) result() [][]byte {
+	kept := append(reservoirHeap(nil), r.samples...)
+	sort.Slice(kept, func(i, j int) bool { return kept[i].index < kept[j].index })
+	res := make([][]byte, len(kept))
+	for i, s := range kept {
+		res[i] = s.b
+	}
+	return res
+}
@@ -0,0 +1,184 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+)
+
+// Builder builds Zstandard dictionaries, reusing memory between builds.
+// This reduces allocations when building many dictionaries.
+// The memory used for selecting content is reused,
+// while building the entropy tables still allocates for each build.
+// A Builder is not safe for concurrent use.
+type Builder struct {
+	o Options
+	s buildScratch
+}
+
+// NewBuilder returns a Builder that builds dictionaries using the provided options.
+func NewBuilder(o Options) *Builder {
+	return &Builder{o: o}
+}
+
+// Build will build a Zstandard dictionary from the provided input.
+// The returned dictionary does not reference memory of the Builder.
+func (b *Builder) Build(input [][]byte) ([]byte, error) {
+	o := b.o
+	o.outFormat = formatZstd
+	o.scratch = &b.s
+	return buildDict(context.Background(), input, nil, o, nil)
+}
+
+// buildScratch contains memory that can be reused between builds.
+type buildScratch struct {
+	// AlgoHash
+	// counts contains the hash counts of the input, if already counted.
+	counts      *hashCounts
+	hashShards  []hashShard
+	wantMatches map[uint32]uint32
+	output      map[uint32]matchValue
+	values      []byte
+	neighbors   []map[uint32]uint32
+	nNeighbors  int
+
+	// AlgoCover and AlgoFastCover
+	cover       cover
+	coverShards []coverShard
+	dense       map[uint32]uint32
+	starts      []int
+	ids         []uint32
+	freqs       []uint32
+	active      []uint32
+	remap       []uint32
+}
+
+// hashShard contains the state of a shard counting hashes.
+type hashShard struct {
+	counts hashCounts
+	found  map[uint32]struct{}
+}
+
+// coverShard contains the state of a shard assigning dmer ids.
+type coverShard struct {
+	dense    map[uint32]uint32
+	hashes   []uint32
+	freqs    []uint32
+	lastSeen []int
+}
+
+// getHashShards returns n empty shards.
+func (s *buildScratch) getHashShards(n int) []hashShard {
+	for len(s.hashShards) < n {
+		s.hashShards = append(s.hashShards, hashShard{
+			counts: hashCounts{
+				matches: make(map[uint32]uint32),
+				offsets: make(map[uint32]int64),
+			},
+			found: make(map[uint32]struct{}),
+		})
+	}
+	shards := s.hashShards[:n]
+	for i := range shards {
+		c := &shards[i].counts
+		clearMap(c.matches)
+		for k := range c.offsets {
+			delete(c.offsets, k)
+		}
+		c.total = 0
+		c.used = 0
+	}
+	return shards
+}
+
+// getWantMatches returns an empty map.
+func (s *buildScratch) getWantMatches(size int) map[uint32]uint32 {
+	if s.wantMatches == nil {
+		s.wantMatches = make(map[uint32]uint32, size)
+	}
+	clearMap(s.wantMatches)
+	return s.wantMatches
+}
+
+// getOutput returns an empty map, and prepares values and neighbors for n entries.
+func (s *buildScratch) getOutput(n, hashBytes int) map[uint32]matchValue {
+	if s.output == nil {
+		s.output = make(map[uint32]matchValue, n)
+	}
+	for k := range s.output {
+		delete(s.output, k)
+	}
+	if cap(s.values) < n*hashBytes {
+		s.values = make([]byte, 0, n*hashBytes)
+	}
+	s.values = s.values[:0]
+	s.nNeighbors = 0
+	return s.output
+}
+
+// getValue returns a copy of the first hashBytes of b.
+// No more than the n values given to getOutput can be returned.
+func (s *buildScratch) getValue(b []byte, hashBytes int) []byte {
+	start := len(s.values)
+	s.values = append(s.values, b[:hashBytes]...)
+	return s.values[start:len(s.values):len(s.values)]
+}
+
+// getNeighbors returns an empty map for counting neighbors.
+func (s *buildScratch) getNeighbors() map[uint32]uint32 {
+	if s.nNeighbors == len(s.neighbors) {
+		s.neighbors = append(s.neighbors, make(map[uint32]uint32, 4))
+	}
+	m := s.neighbors[s.nNeighbors]
+	s.nNeighbors++
+	clearMap(m)
+	return m
+}
+
+// getCoverShards returns n shards with empty state.
+func (s *buildScratch) getCoverShards(n int) []coverShard {
+	for len(s.coverShards) < n {
+		s.coverShards = append(s.coverShards, coverShard{dense: make(map[uint32]uint32)})
+	}
+	shards := s.coverShards[:n]
+	for i := range shards {
+		sh := &shards[i]
+		clearMap(sh.dense)
+		sh.hashes = sh.hashes[:0]
+		sh.freqs = sh.freqs[:0]
+		sh.lastSeen = sh.lastSeen[:0]
+	}
+	return shards
+}
+
+// getDense returns an empty map.
+func (s *buildScratch) getDense() map[uint32]uint32 {
+	if s.dense == nil {
+		s.dense = make(map[uint32]uint32)
+	}
+	clearMap(s.dense)
+	return s.dense
+}
+
+// clearMap removes all entries from m.
+func clearMap(m map[uint32]uint32) {
+	for k := range m {
+		delete(m, k)
+	}
+}
+
+// zeroUint32s returns a slice of n zeros, reusing the memory of *buf if possible.
+func zeroUint32s(buf *[]uint32, n int) []uint32 {
+	if cap(*buf) < n {
+		*buf = make([]uint32, n)
+		return *buf
+	}
+	b := (*buf)[:n]
+	for i := range b {
+		b[i] = 0
+	}
+	*buf = b
+	return b
+}
@@ -0,0 +1,87 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"fmt"
+)
+
+// BuildZstdDictSizes will build a Zstandard dictionary for each of the provided content sizes.
+// The samples are only indexed once, and the content of smaller dictionaries
+// is the highest ranked segments of the largest dictionary.
+// The dictionary of the largest size is identical to building with MaxDictSize set to that size.
+// o.MaxDictSize is ignored.
+//
+// The dictionaries are returned keyed by size.
+func BuildZstdDictSizes(input [][]byte, sizes []int, o Options) (map[int][]byte, error) {
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("no sizes provided")
+	}
+	maxSize := 0
+	for _, size := range sizes {
+		if size > maxSize {
+			maxSize = size
+		}
+	}
+	o.MaxDictSize = maxSize
+	o.outFormat = formatZstd
+	stats := DictStats{wantSegments: true}
+	input, w, holdout, err := prepareSamples(input, nil, &o, &stats)
+	if err != nil {
+		return nil, err
+	}
+	for _, size := range sizes {
+		if size < 8 {
+			return nil, fmt.Errorf("dict: MaxDictSize must be at least 8, got %d", size)
+		}
+		if n := requiredSize(o.RequiredSegments); n > size {
+			return nil, fmt.Errorf("RequiredSegments are %d bytes, exceeding size %d by %d bytes", n, size, n-size)
+		}
+	}
+	content, firstOffsets, err := selectContent(context.Background(), input, w, o, &stats)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[int][]byte, len(sizes))
+	for _, size := range sizes {
+		if _, ok := res[size]; ok {
+			continue
+		}
+		c := content
+		if size < maxSize {
+			c = segmentsContent(stats.segments, size)
+		}
+		so := o
+		so.MaxDictSize = size
+		res[size], err = finishChecked(input, holdout, c, firstOffsets, so, &stats)
+		if err != nil {
+			return nil, fmt.Errorf("size %d: %w", size, err)
+		}
+	}
+	return res, nil
+}
+
+// segmentsContent returns dictionary content of up to size bytes from segments,
+// in the order they were selected. The last segment is truncated to fit.
+func segmentsContent(segments []Segment, size int) []byte {
+	n := 0
+	for i, seg := range segments {
+		if n+len(seg.Content) >= size {
+			segments = segments[:i+1]
+			break
+		}
+		n += len(seg.Content)
+	}
+	dst := make([]byte, 0, size)
+	for i := len(segments) - 1; i >= 0; i-- {
+		b := segments[i].Content
+		if i == len(segments)-1 && n+len(b) > size {
+			b = b[:size-n]
+		}
+		dst = append(dst, b...)
+	}
+	return dst
+}
@@ -0,0 +1,55 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"math"
+	"math/rand"
+)
+
+const (
+	// buildHoldoutFraction is the fraction of samples held out for evaluation by the builder.
+	buildHoldoutFraction = 0.1
+
+	// buildHoldoutSeed is the seed used for selecting the samples held out by the builder.
+	buildHoldoutSeed = 1
+)
+
+// SplitSamples splits samples into samples for training and samples held out for evaluation,
+// for example with EstimateRatio or Benchmark.
+// The number of held out samples is holdoutFraction of all samples, rounded to nearest.
+// holdoutFraction is clamped to the range 0 to 1.
+//
+// Samples are selected randomly using seed, so the same samples, fraction and seed
+// always give the same split. Both results keep the order of samples.
+// The builder selects samples for Options.VerifyBenefit, Options.AdaptiveEntropy
+// and Options.AutoHashBytes the same way, holding out 10% of the samples.
+func SplitSamples(samples [][]byte, holdoutFraction float64, seed int64) (train, holdout [][]byte) {
+	if !(holdoutFraction > 0) {
+		holdoutFraction = 0
+	}
+	if holdoutFraction > 1 {
+		holdoutFraction = 1
+	}
+	isHoldout := holdoutSamples(len(samples), holdoutFraction, seed)
+	for i, b := range samples {
+		if isHoldout[i] {
+			holdout = append(holdout, b)
+		} else {
+			train = append(train, b)
+		}
+	}
+	return train, holdout
+}
+
+// holdoutSamples returns which of n samples are held out, when holding out fraction of the samples.
+func holdoutSamples(n int, fraction float64, seed int64) []bool {
+	k := int(math.Round(float64(n) * fraction))
+	res := make([]bool, n)
+	for _, i := range rand.New(rand.NewSource(seed)).Perm(n)[:k] {
+		res[i] = true
+	}
+	return res
+}
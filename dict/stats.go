@@ -0,0 +1,211 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"math/bits"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// scoreHistogramBuckets is the number of buckets in DictStats.ScoreHistogram.
+const scoreHistogramBuckets = 32
+
+// DictStats contains statistics about a dictionary build.
+type DictStats struct {
+	// Candidates is the number of candidate segments considered.
+	// For AlgoHash this is the number of frequent matches,
+	// for AlgoCover and AlgoFastCover the number of epochs searched.
+	Candidates int
+
+	// ScoreHistogram is the number of candidate segments by score.
+	// Bucket 0 counts scores below 2, and bucket i counts scores from 2^i up to 2^(i+1).
+	// The last bucket also counts all higher scores.
+	// The buckets add up to Candidates.
+	//
+	// Scores are the weighted number of occurrences of a match for AlgoHash,
+	// and the weighted number of matches in the segment for AlgoCover and AlgoFastCover.
+	// If most candidates are in the lowest buckets, content added by a larger
+	// MaxDictSize is unlikely to improve compression much.
+	ScoreHistogram []int
+
+	// Selected is the number of segments in the dictionary content.
+	Selected int
+
+	// Excluded is the number of candidate segments skipped
+	// because they contain one of Options.ExcludeSequences.
+	Excluded int
+
+	// Infrequent is the number of candidate segments skipped because they
+	// are contained in fewer than Options.MinSegmentFrequency samples.
+	Infrequent int
+
+	// BudgetExceeded is true if content selection was stopped by Options.TimeBudget.
+	BudgetExceeded bool
+
+	// ContentSize is the size of the dictionary content.
+	ContentSize int
+
+	// TablesSize is the size of the dictionary excluding the content.
+	// For Zstandard dictionaries this is the header, entropy tables and repeat offsets.
+	TablesSize int
+
+	// EntropyTablesSize is the part of TablesSize used by entropy tables.
+	// This excludes the magic number, dictionary ID and repeat offsets.
+	EntropyTablesSize int
+
+	// EntropyTablesOmitted is true if a Zstandard dictionary was returned as content only,
+	// because of Options.MaxEntropyTableBytes or Options.AdaptiveEntropy.
+	EntropyTablesOmitted bool
+
+	// ZstdLevel is the encoder level the entropy tables were built for.
+	// Only set for Zstandard dictionaries.
+	ZstdLevel zstd.EncoderLevel
+
+	// HashBytes is the HashBytes used.
+	// With Options.AutoHashBytes this is the selected value.
+	HashBytes int
+
+	// Samples is the number of samples the dictionary was built from,
+	// after samples were removed by Options.MaxSamples, Options.MinSampleSize and Options.Dedup.
+	Samples int
+
+	// SamplesUsed is the number of samples that were long enough to be indexed.
+	SamplesUsed int
+
+	// TooSmall is the number of samples removed by Options.MinSampleSize.
+	TooSmall int
+
+	// Truncated is the number of samples truncated to Options.MaxSampleSize.
+	Truncated int
+
+	// Duplicates is the number of duplicate samples removed by Options.Dedup.
+	Duplicates int
+
+	// Coverage is the fraction of sample bytes that are part of
+	// at least one HashBytes long match in the dictionary content.
+	Coverage float64
+
+	// Improvement is the fraction the compressed size was reduced by.
+	// Only set when Options.VerifyBenefit is set.
+	Improvement float64
+
+	// Timings is the time spent in each phase of the build.
+	Timings Timings
+
+	// wantSegments will collect the selected segments in segments.
+	wantSegments bool
+	segments     []Segment
+}
+
+// Timings is the time spent in each phase of a dictionary build.
+type Timings struct {
+	// Prepare is the time spent checking options and selecting, truncating and weighting samples.
+	// With Options.AutoHashBytes this includes the builds comparing HashBytes.
+	Prepare time.Duration
+
+	// Index is the time spent counting the matches in the samples.
+	// This is usually the largest part of the build, and can be reduced
+	// with Options.MaxSamples or Options.MaxSampleSize.
+	Index time.Duration
+
+	// Select is the time spent scoring candidates and selecting the content.
+	Select time.Duration
+
+	// Entropy is the time spent building the dictionary from the content.
+	// For Zstandard dictionaries this is mostly compressing samples to build the entropy tables,
+	// which Options.RawContentOnly skips. This includes checking Options.VerifyBenefit.
+	Entropy time.Duration
+
+	// Total is the time spent on the whole build.
+	Total time.Duration
+}
+
+// addScore adds a candidate score to the histogram.
+func (s *DictStats) addScore(score float64) {
+	if s.ScoreHistogram == nil {
+		s.ScoreHistogram = make([]int, scoreHistogramBuckets)
+	}
+	b := 0
+	if score >= 2 {
+		b = bits.Len64(uint64(score)) - 1
+	}
+	if b >= scoreHistogramBuckets {
+		b = scoreHistogramBuckets - 1
+	}
+	s.ScoreHistogram[b]++
+}
+
+// BuildZstdDictWithStats will build a Zstandard dictionary from the provided input,
+// and return statistics about the build.
+func BuildZstdDictWithStats(input [][]byte, o Options) ([]byte, DictStats, error) {
+	var stats DictStats
+	o.outFormat = formatZstd
+	d, err := buildDict(context.Background(), input, nil, o, &stats)
+	return d, stats, err
+}
+
+// driftHashBytes is the match length used by DriftScore.
+const driftHashBytes = 6
+
+// DriftScore returns the fraction of sample bytes that are part of
+// at least one 6 byte match in the dictionary content, like DictStats.Coverage.
+// Compared to the coverage of the samples the dictionary was built from,
+// a lower score means the samples have drifted from the dictionary.
+// This can be used to decide whether a dictionary needs to be rebuilt.
+// Both Zstandard and raw dictionaries are accepted.
+func DriftScore(dict []byte, samples [][]byte) (float64, error) {
+	if len(samples) == 0 {
+		return 0, ErrNoSamples
+	}
+	content, err := ToRawContent(dict)
+	if err != nil {
+		return 0, err
+	}
+	return coverage(content, samples, driftHashBytes), nil
+}
+
+// coverage returns the fraction of bytes in input that are part of
+// a hashBytes long match in content.
+func coverage(content []byte, input [][]byte, hashBytes int) float64 {
+	covered, total := coveredBytes(content, input, hashBytes)
+	if total == 0 {
+		return 0
+	}
+	return float64(covered) / float64(total)
+}
+
+// coveredBytes returns the number of bytes in input that are part of
+// a hashBytes long match in content, and the total number of bytes in input.
+func coveredBytes(content []byte, input [][]byte, hashBytes int) (covered, total int) {
+	for _, b := range input {
+		total += len(b)
+	}
+	if len(content) < hashBytes {
+		return 0, total
+	}
+	found := make(map[uint32]struct{}, len(content))
+	for i := 0; i+hashBytes <= len(content); i++ {
+		found[hashLen(load64(content, i), 32, uint8(hashBytes))] = struct{}{}
+	}
+	for _, b := range input {
+		// Bytes up to end are already counted.
+		end := 0
+		for i := 0; i+hashBytes <= len(b); i++ {
+			if _, ok := found[hashLen(load64(b, i), 32, uint8(hashBytes))]; !ok {
+				continue
+			}
+			start := i
+			if start < end {
+				start = end
+			}
+			end = i + hashBytes
+			covered += end - start
+		}
+	}
+	return covered, total
+}
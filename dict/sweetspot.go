@@ -0,0 +1,58 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"fmt"
+	"sort"
+)
+
+// sweetSpotMinGain is the smallest improvement of the ratio per KiB of content
+// for which FindSweetSpot considers a larger dictionary worth it.
+const sweetSpotMinGain = 0.001
+
+// FindSweetSpot builds a Zstandard dictionary for each of the provided content sizes
+// and returns the size past which additional dictionary bytes stop paying off.
+// The dictionaries are built as by BuildZstdDictSizes, so the samples are only indexed once.
+// o.MaxDictSize is ignored.
+//
+// The ratio of each size is measured by EstimateRatio on a holdout part of the samples,
+// and returned keyed by size.
+// Going through sizes from smallest to largest, the next size is chosen as long as the ratio
+// improves by at least 0.001 per KiB of added content. The knee of the curve is returned.
+func FindSweetSpot(samples [][]byte, sizes []int, o Options) (bestSize int, stats map[int]float64, err error) {
+	if len(sizes) == 0 {
+		return 0, nil, fmt.Errorf("no sizes provided")
+	}
+	if len(samples) == 0 {
+		return 0, nil, ErrNoSamples
+	}
+	println, _ := o.printers()
+	train, _, holdout := splitHoldout(samples, nil)
+	dicts, err := BuildZstdDictSizes(train, sizes, o)
+	if err != nil {
+		return 0, nil, err
+	}
+	sorted := make([]int, 0, len(dicts))
+	stats = make(map[int]float64, len(dicts))
+	for size, dict := range dicts {
+		stats[size], err = EstimateRatio(dict, holdout, o.ZstdLevel)
+		if err != nil {
+			return 0, nil, fmt.Errorf("size %d: %w", size, err)
+		}
+		sorted = append(sorted, size)
+	}
+	sort.Ints(sorted)
+	bestSize = sorted[0]
+	for _, size := range sorted[1:] {
+		gain := (stats[bestSize] - stats[size]) / float64(size-bestSize) * 1024
+		println("Content size", size, "ratio", stats[size], "gain per KiB", gain)
+		if gain < sweetSpotMinGain {
+			break
+		}
+		bestSize = size
+	}
+	return bestSize, stats, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"fmt"
+)
+
+// targetStartSize is the first content size tried by BuildZstdDictToTarget.
+const targetStartSize = 1 << 10
+
+// BuildZstdDictToTarget will build Zstandard dictionaries of increasing size
+// until the ratio measured by EstimateRatio on a holdout part of the samples
+// is at or below targetRatio, or the content size reaches maxSize.
+// o.MaxDictSize is ignored.
+//
+// The content size starts at 1KB and is doubled for each attempt.
+// The last dictionary built is returned with its measured ratio,
+// even if the target was not met.
+func BuildZstdDictToTarget(input [][]byte, targetRatio float64, maxSize int, o Options) ([]byte, float64, error) {
+	if targetRatio <= 0 {
+		return nil, 0, fmt.Errorf("targetRatio must be > 0, got %v", targetRatio)
+	}
+	if maxSize < 8 {
+		return nil, 0, fmt.Errorf("maxSize must be at least 8, got %d", maxSize)
+	}
+	if len(input) == 0 {
+		return nil, 0, ErrNoSamples
+	}
+	println, _ := o.printers()
+	train, _, holdout := splitHoldout(input, nil)
+	o.outFormat = formatZstd
+	size := targetStartSize
+	for {
+		if size > maxSize {
+			size = maxSize
+		}
+		o.MaxDictSize = size
+		dict, err := buildDict(context.Background(), train, nil, o, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		ratio, err := EstimateRatio(dict, holdout, o.ZstdLevel)
+		if err != nil {
+			return nil, 0, err
+		}
+		println("Content size", size, "ratio", ratio)
+		if ratio <= targetRatio || size == maxSize {
+			return dict, ratio, nil
+		}
+		size *= 2
+	}
+}
+
+// splitHoldout splits input into samples for training and 10% of the samples for evaluation,
+// selected as by SplitSamples with a fixed seed. At least one sample is held out.
+// If weights is non-nil, the weights of the training samples are returned as well.
+// If there are less than 2 samples, all samples are used for both.
+func splitHoldout(input [][]byte, weights []float64) (train [][]byte, trainW []float64, holdout [][]byte) {
+	if len(input) < 2 {
+		return input, weights, input
+	}
+	fraction := buildHoldoutFraction
+	if least := 1 / float64(len(input)); fraction < least {
+		fraction = least
+	}
+	isHoldout := holdoutSamples(len(input), fraction, buildHoldoutSeed)
+	for i, b := range input {
+		if isHoldout[i] {
+			holdout = append(holdout, b)
+			continue
+		}
+		train = append(train, b)
+		if weights != nil {
+			trainW = append(trainW, weights[i])
+		}
+	}
+	return train, trainW, holdout
+}
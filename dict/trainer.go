@@ -0,0 +1,95 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+)
+
+// Trainer builds Zstandard dictionaries from samples that are added one at a time.
+//
+// With AlgoHash, matches are counted as samples are added, so Finish only selects content.
+// If Options.MaxMemoryBytes is set the less frequent matches are removed
+// when the limit is reached, as for BuildZstdDict.
+// MinSampleSize and MaxSampleSize are applied when samples are added.
+// Other algorithms, a Direction other than DirForward, AutoHashBytes, RecencyDecay, NormalizeBySize, WeightByDifficulty and the options that select samples
+// (MaxSamples, Shuffle, Dedup, VerifyBenefit and AdaptiveEntropy) make Finish count all samples.
+//
+// Since dictionary content is copied from the samples, all samples are kept in memory.
+// A Trainer is not safe for concurrent use.
+type Trainer struct {
+	o       Options
+	err     error
+	samples [][]byte
+	counts  hashCounts
+	found   map[uint32]struct{}
+	s       buildScratch
+}
+
+// NewTrainer returns a Trainer that builds dictionaries using the provided options.
+// If the options are invalid, samples are not added and Finish returns the error.
+func NewTrainer(o Options) *Trainer {
+	o.outFormat = formatZstd
+	return &Trainer{
+		o:   o,
+		err: o.validate(),
+		counts: hashCounts{
+			matches: make(map[uint32]uint32),
+			offsets: make(map[uint32]int64),
+		},
+		found: make(map[uint32]struct{}),
+	}
+}
+
+// Add adds a sample. The sample is copied, so the caller may reuse it.
+func (t *Trainer) Add(sample []byte) {
+	if t.err != nil || len(sample) < t.o.MinSampleSize {
+		return
+	}
+	if t.o.MaxSampleSize > 0 && len(sample) > t.o.MaxSampleSize {
+		sample = sample[:t.o.MaxSampleSize]
+	}
+	sample = append([]byte(nil), sample...)
+	t.samples = append(t.samples, sample)
+	if t.incremental() {
+		t.counts.add(sample, 1, t.o.hasher(), t.found)
+		t.counts.prune(int(t.o.MaxMemoryBytes / hashCountBytes))
+	}
+}
+
+// Finish builds a Zstandard dictionary from the samples added so far.
+// More samples can be added after Finish, and Finish called again.
+// The returned dictionary does not reference memory of the Trainer.
+func (t *Trainer) Finish() ([]byte, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	o := t.o
+	o.scratch = &t.s
+	t.s.counts = nil
+	if t.incremental() && len(t.samples) > 1 {
+		t.s.counts = &t.counts
+	}
+	return buildDict(context.Background(), t.samples, nil, o, nil)
+}
+
+// Reset removes all samples and match counts, so the Trainer can be used for a new set of samples.
+// Memory is kept for reuse, and the Trainer builds the same dictionaries as a new Trainer
+// with the same options.
+func (t *Trainer) Reset() {
+	for i := range t.samples {
+		t.samples[i] = nil
+	}
+	t.samples = t.samples[:0]
+	t.counts.reset()
+}
+
+// incremental returns whether the matches counted by Add can be used by Finish.
+func (t *Trainer) incremental() bool {
+	o := t.o
+	return o.Algorithm == AlgoHash && o.Direction == DirForward && !o.AutoHashBytes &&
+		o.MaxSamples == 0 && !o.Shuffle && !o.Dedup && !o.VerifyBenefit && !o.AdaptiveEntropy &&
+		o.RecencyDecay == 0 && !o.NormalizeBySize && !o.WeightByDifficulty
+}
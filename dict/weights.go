@@ -0,0 +1,151 @@
+// Copyright 2023+ Klaus Post. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/klauspost/compress/s2"
+)
+
+// BuildZstdDictWeighted will build a Zstandard dictionary from the provided input,
+// where the contribution of each sample is multiplied by its weight.
+//
+// This can be used to supply deduplicated samples with their number of occurrences as weights,
+// instead of repeating samples.
+// There must be a weight for each sample, and weights must be >= 0.
+// Only the relative size of weights matters.
+func BuildZstdDictWeighted(input [][]byte, weights []float64, o Options) ([]byte, error) {
+	if len(weights) != len(input) {
+		return nil, fmt.Errorf("got %d weights for %d samples", len(weights), len(input))
+	}
+	o.outFormat = formatZstd
+	return buildDict(context.Background(), input, weights, o, nil)
+}
+
+// weightUnit is the fixed point value of an average sample weight.
+const weightUnit = 16
+
+// sampleWeights contains fixed point sample weights.
+// Using integers keeps counts exact regardless of the order they are added.
+// A nil sampleWeights gives all samples a weight of 1.
+type sampleWeights []uint32
+
+// get returns the weight of sample i.
+func (w sampleWeights) get(i int) uint32 {
+	if w == nil {
+		return 1
+	}
+	return w[i]
+}
+
+// unscale converts a sum of weights to the equivalent number of samples with weight 1.
+func (w sampleWeights) unscale(v uint64) float64 {
+	if w == nil {
+		return float64(v)
+	}
+	return float64(v) / weightUnit
+}
+
+// newSampleWeights converts weights to fixed point.
+// Weights are scaled so the average weight is weightUnit.
+// Positive weights are at least 1.
+func newSampleWeights(weights []float64) (sampleWeights, error) {
+	if weights == nil {
+		return nil, nil
+	}
+	var sum float64
+	for i, w := range weights {
+		if w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+			return nil, fmt.Errorf("invalid weight %v for sample %d", w, i)
+		}
+		sum += w
+	}
+	if sum == 0 {
+		return nil, fmt.Errorf("all sample weights are 0")
+	}
+	scale := weightUnit * float64(len(weights)) / sum
+	res := make(sampleWeights, len(weights))
+	for i, w := range weights {
+		if w == 0 {
+			continue
+		}
+		v := math.Round(w * scale)
+		if v < 1 {
+			v = 1
+		}
+		res[i] = uint32(v)
+	}
+	return res, nil
+}
+
+// recencyWeights returns weights for n samples in chronological order,
+// multiplied by an exponential decay so the last sample keeps its weight
+// and the first is multiplied by exp(-decay).
+// If weights is nil, all samples start with weight 1.
+func recencyWeights(weights []float64, n int, decay float64) []float64 {
+	res := make([]float64, n)
+	for i := range res {
+		w := 1.0
+		if weights != nil {
+			w = weights[i]
+		}
+		age := 0.0
+		if n > 1 {
+			age = float64(n-1-i) / float64(n-1)
+		}
+		res[i] = w * math.Exp(-decay*age)
+	}
+	return res
+}
+
+// sizeWeights returns weights divided by the size of each sample.
+// Empty samples are treated as 1 byte.
+// If weights is nil, all samples start with weight 1.
+func sizeWeights(weights []float64, input [][]byte) []float64 {
+	res := make([]float64, len(input))
+	for i, b := range input {
+		w := 1.0
+		if weights != nil {
+			w = weights[i]
+		}
+		n := len(b)
+		if n < 1 {
+			n = 1
+		}
+		res[i] = w / float64(n)
+	}
+	return res
+}
+
+// difficultyWeights returns weights multiplied by the S2 compressed size of each sample
+// divided by its size. Samples are compressed by up to concurrency goroutines.
+// Empty samples keep their weight.
+// If weights is nil, all samples start with weight 1.
+func difficultyWeights(weights []float64, input [][]byte, concurrency int) []float64 {
+	res := make([]float64, len(input))
+	_ = runShards(context.Background(), len(input), concurrency, func(_, start, end int) error {
+		var dst []byte
+		for i := start; i < end; i++ {
+			w := 1.0
+			if weights != nil {
+				w = weights[i]
+			}
+			b := input[i]
+			if len(b) > 0 {
+				if n := s2.MaxEncodedLen(len(b)); cap(dst) < n {
+					dst = make([]byte, n)
+				}
+				dst = s2.Encode(dst[:cap(dst)], b)
+				w *= float64(len(dst)) / float64(len(b))
+			}
+			res[i] = w
+		}
+		return nil
+	})
+	return res
+}
@@ -240,6 +240,29 @@ func (h *Header) DecodeAndStrip(in []byte) (remain []byte, err error) {
 	return in, nil
 }
 
+// GetDictID returns the dictionary ID required to decode the first frame in the input.
+// Only the frame header is parsed, so no dictionary has to be registered.
+// Skippable frames before the frame are skipped if they are fully contained in the input.
+// ok will be false if the frame does not use a dictionary.
+// If the frame header cannot be read an error will be returned.
+func GetDictID(frame []byte) (id uint32, ok bool, err error) {
+	var h Header
+	for {
+		remain, err := h.DecodeAndStrip(frame)
+		if err != nil {
+			return 0, false, err
+		}
+		if !h.Skippable {
+			break
+		}
+		if uint64(len(remain)) < uint64(h.SkippableSize) {
+			return 0, false, io.ErrUnexpectedEOF
+		}
+		frame = remain[h.SkippableSize:]
+	}
+	return h.DictionaryID, h.DictionaryID != 0, nil
+}
+
 // AppendTo will append the encoded header to the dst slice.
 // There is no error checking performed on the header values.
 func (h *Header) AppendTo(dst []byte) ([]byte, error) {
@@ -96,3 +96,52 @@ func TestHeader_Decode(t *testing.T) {
 		t.SkipNow()
 	}
 }
+
+func TestGetDictID(t *testing.T) {
+	content := bytes.Repeat([]byte("dictionary content "), 10)
+	for _, id := range []uint32{1, 255, 256, 65536, 1 << 31} {
+		enc, err := NewWriter(nil, WithEncoderDictRaw(id, content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := enc.EncodeAll([]byte("some dictionary content to compress"), nil)
+		enc.Close()
+		got, ok, err := GetDictID(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || got != id {
+			t.Errorf("got id %d, ok %v, want id %d", got, ok, id)
+		}
+		// Only the header is needed.
+		got, ok, err = GetDictID(frame[:HeaderMaxSize])
+		if err != nil || !ok || got != id {
+			t.Errorf("truncated frame: got id %d, ok %v, err %v, want id %d", got, ok, err, id)
+		}
+
+		// Skippable frames are skipped.
+		skip := Header{Skippable: true, SkippableSize: 3}
+		withSkip, _ := skip.AppendTo(nil)
+		withSkip = append(withSkip, 1, 2, 3)
+		got, ok, err = GetDictID(append(withSkip, frame...))
+		if err != nil || !ok || got != id {
+			t.Errorf("skippable frame: got id %d, ok %v, err %v, want id %d", got, ok, err, id)
+		}
+	}
+
+	enc, err := NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	frame := enc.EncodeAll([]byte("no dictionary"), nil)
+	if id, ok, err := GetDictID(frame); err != nil || ok || id != 0 {
+		t.Errorf("no dictionary: got id %d, ok %v, err %v", id, ok, err)
+	}
+	if _, _, err := GetDictID(frame[:3]); err != io.ErrUnexpectedEOF {
+		t.Errorf("short input: got err %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, _, err := GetDictID([]byte("not a zstd frame")); err != ErrMagicMismatch {
+		t.Errorf("invalid input: got err %v, want %v", err, ErrMagicMismatch)
+	}
+}
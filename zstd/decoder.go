@@ -40,7 +40,7 @@ type Decoder struct {
 	frame *frameDec
 
 	// Custom dictionaries.
-	dicts map[uint32]*dict
+	dicts dictCache
 
 	// streamWg is the waitgroup for all streams
 	streamWg sync.WaitGroup
@@ -102,9 +102,9 @@ func NewReader(r io.Reader, opts ...DOption) (*Decoder, error) {
 	}
 
 	// Transfer option dicts.
-	d.dicts = make(map[uint32]*dict, len(d.o.dicts))
+	d.dicts.max = d.o.maxDicts
 	for _, dc := range d.o.dicts {
-		d.dicts[dc.id] = dc
+		d.dicts.add(dc)
 	}
 	d.o.dicts = nil
 
@@ -930,8 +930,26 @@ decodeStream:
 	d.frame.history.b = frameHistCache
 }
 
+// RegisterDict adds a dictionary in the format of WithDecoderDicts.
+// If a dictionary with the same ID is registered, it is replaced.
+// RegisterDict can be called while decoding.
+// Frames already being decoded will continue to use the dictionary they started with.
+func (d *Decoder) RegisterDict(dict []byte) error {
+	dc, err := loadDict(dict)
+	if err != nil {
+		return err
+	}
+	d.dicts.add(dc)
+	return nil
+}
+
 func (d *Decoder) setDict(frame *frameDec) (err error) {
-	dict, ok := d.dicts[frame.DictionaryID]
+	dict, ok := d.dicts.get(frame.DictionaryID)
+	// Frames without a dictionary ID use raw content, such as a delta base,
+	// which may start with the dictionary magic by chance.
+	if ok && frame.DictionaryID != 0 && dict.headerID != 0 && dict.headerID != frame.DictionaryID {
+		return ErrDictIDMismatch{Frame: frame.DictionaryID, Registered: dict.headerID}
+	}
 	if ok {
 		if debugDecoder {
 			println("setting dict", frame.DictionaryID)
@@ -942,7 +960,7 @@ func (d *Decoder) setDict(frame *frameDec) (err error) {
 		// either dictionary zero, or no dictionary. In particular,
 		// zstd --patch-from uses this id for the source file,
 		// so only return an error if the dictionary id is not zero.
-		err = ErrUnknownDictionary
+		err = UnknownDictionaryError{ID: frame.DictionaryID}
 	}
 	return err
 }
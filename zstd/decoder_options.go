@@ -5,6 +5,7 @@
 package zstd
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math/bits"
@@ -21,6 +22,7 @@ type decoderOptions struct {
 	maxDecodedSize  uint64
 	maxWindowSize   uint64
 	dicts           []*dict
+	maxDicts        int
 	ignoreChecksum  bool
 	limitToCap      bool
 	decodeBufsBelow int
@@ -93,6 +95,12 @@ func WithDecoderMaxMemory(n uint64) DOption {
 //
 // If several dictionaries with the same ID are provided, the last one will be used.
 //
+// Dictionaries are parsed when the decoder is created. Decoding a frame only references
+// the parsed tables and content, so there is no dictionary setup for each DecodeAll call.
+//
+// Frames without a dictionary ID are decoded without a dictionary,
+// so frames compressed with and without a dictionary can be mixed.
+//
 // [dictionary format]: https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md#dictionary-format
 func WithDecoderDicts(dicts ...[]byte) DOption {
 	return func(o *decoderOptions) error {
@@ -109,12 +117,34 @@ func WithDecoderDicts(dicts ...[]byte) DOption {
 
 // WithDecoderDictRaw registers a dictionary that may be used by the decoder.
 // The slice content can be arbitrary data.
+// If content is a complete dictionary with an ID other than id,
+// frames using id return ErrDictIDMismatch.
+// This is not checked for id 0, which is used for raw content such as a delta base.
 func WithDecoderDictRaw(id uint32, content []byte) DOption {
 	return func(o *decoderOptions) error {
 		if bits.UintSize > 32 && uint(len(content)) > dictMaxLength {
 			return fmt.Errorf("dictionary of size %d > 2GiB too large", len(content))
 		}
-		o.dicts = append(o.dicts, &dict{id: id, content: content, offsets: [3]int{1, 4, 8}})
+		d := &dict{id: id, content: content, offsets: [3]int{1, 4, 8}}
+		if len(content) >= 8 && string(content[:4]) == dictMagic {
+			d.headerID = binary.LittleEndian.Uint32(content[4:8])
+		}
+		o.dicts = append(o.dicts, d)
+		return nil
+	}
+}
+
+// WithDecoderDictCache limits the number of dictionaries kept by the decoder.
+// When more dictionaries are registered, the least recently used dictionary is removed.
+// Frames using a removed dictionary will return an UnknownDictionaryError with the ID,
+// after which the dictionary can be added again with Decoder.RegisterDict.
+// If 0, the number of dictionaries is not limited, which is the default.
+func WithDecoderDictCache(maxDicts int) DOption {
+	return func(o *decoderOptions) error {
+		if maxDicts < 0 {
+			return errors.New("maxDicts must be >= 0")
+		}
+		o.maxDicts = maxDicts
 		return nil
 	}
 }
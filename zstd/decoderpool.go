@@ -0,0 +1,108 @@
+// Copyright 2019+ Klaus Post. All rights reserved.
+// License information can be found in the LICENSE file.
+
+package zstd
+
+import (
+	"errors"
+	"sync"
+)
+
+// DecoderPool is a bounded pool of decoders created with the same options,
+// for example dictionaries added with WithDecoderDicts.
+// Decoders are created when needed, up to the maximum, and reused after Put.
+// A DecoderPool is safe for concurrent use.
+type DecoderPool struct {
+	opts []DOption
+
+	// sem has a token for each decoder that has been returned by Get and not Put.
+	sem chan struct{}
+
+	mu     sync.Mutex
+	idle   []*Decoder
+	closed bool
+}
+
+// NewDecoderPool returns a pool of at most maxDecoders decoders.
+// Decoders use a concurrency of 1, unless WithDecoderConcurrency is supplied.
+// One decoder is created to check the options, so invalid options return an error.
+func NewDecoderPool(maxDecoders int, opts ...DOption) (*DecoderPool, error) {
+	if maxDecoders < 1 {
+		return nil, errors.New("maxDecoders must be at least 1")
+	}
+	p := &DecoderPool{
+		opts: append([]DOption{WithDecoderConcurrency(1)}, opts...),
+		sem:  make(chan struct{}, maxDecoders),
+	}
+	dec, err := NewReader(nil, p.opts...)
+	if err != nil {
+		return nil, err
+	}
+	p.idle = append(p.idle, dec)
+	return p, nil
+}
+
+// Get returns a decoder from the pool.
+// If maxDecoders decoders are in use, Get blocks until one is returned with Put.
+// The decoder has no input, so call Reset before reading, or use DecodeAll.
+// ErrDecoderClosed is returned if the pool is closed.
+func (p *DecoderPool) Get() (*Decoder, error) {
+	p.sem <- struct{}{}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.sem
+		return nil, ErrDecoderClosed
+	}
+	if n := len(p.idle); n > 0 {
+		dec := p.idle[n-1]
+		p.idle[n-1] = nil
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return dec, nil
+	}
+	p.mu.Unlock()
+	dec, err := NewReader(nil, p.opts...)
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+	return dec, nil
+}
+
+// Put returns a decoder obtained from Get to the pool.
+// The decoder is reset to release its input, and must not be used after Put.
+// Decoders that have been closed are discarded, and a new decoder is created when needed.
+// If the pool is closed, the decoder is closed.
+func (p *DecoderPool) Put(dec *Decoder) {
+	if dec == nil {
+		return
+	}
+	keep := dec.Reset(nil) == nil
+	p.mu.Lock()
+	if p.closed {
+		keep = false
+	}
+	if keep {
+		p.idle = append(p.idle, dec)
+	}
+	p.mu.Unlock()
+	if !keep {
+		dec.Close()
+	}
+	<-p.sem
+}
+
+// Close closes all idle decoders.
+// Decoders in use are closed when they are returned with Put.
+// Get returns ErrDecoderClosed after Close.
+func (p *DecoderPool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+	for _, dec := range idle {
+		dec.Close()
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2019+ Klaus Post. All rights reserved.
+// License information can be found in the LICENSE file.
+
+package zstd
+
+import (
+	"math/bits"
+)
+
+// EncodeDelta compresses target using base as a raw content dictionary
+// and appends the patch to dst.
+// Content that is shared with base is encoded as matches,
+// so a target identical to base compresses to a few bytes.
+//
+// The patch is a regular zstd frame with no dictionary ID,
+// compatible with 'zstd --patch-from'.
+// If base is larger than MaxWindowSize only the end of it will be used.
+//
+// Faster levels index fewer positions of base, so matches may not be found in large bases.
+// For bases above 128KB SpeedDefault should be used,
+// and above 1MB SpeedBetterCompression or SpeedBestCompression.
+// Invalid levels will use SpeedDefault.
+func EncodeDelta(dst, base, target []byte, level EncoderLevel) []byte {
+	if level < SpeedFastest || level > SpeedBestCompression {
+		level = SpeedDefault
+	}
+	base = deltaBase(base)
+	enc, err := NewWriter(nil,
+		WithEncoderLevel(level),
+		WithEncoderConcurrency(1),
+		WithWindowSize(deltaWindowSize(len(base)+len(target))),
+		WithEncoderDictRaw(0, base))
+	if err != nil {
+		// Options are always valid.
+		panic(err)
+	}
+	defer enc.Close()
+	return enc.EncodeAll(target, dst)
+}
+
+// DecodeDelta decodes a patch created by EncodeDelta and appends the output to dst.
+// base must be the same as was used for creating the patch.
+func DecodeDelta(dst, base, patch []byte) ([]byte, error) {
+	dec, err := NewReader(nil,
+		WithDecoderConcurrency(1),
+		WithDecoderDictRaw(0, deltaBase(base)))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	return dec.DecodeAll(patch, dst)
+}
+
+// deltaBase returns the part of base that can be referenced.
+func deltaBase(base []byte) []byte {
+	if len(base) > MaxWindowSize {
+		return base[len(base)-MaxWindowSize:]
+	}
+	return base
+}
+
+// deltaWindowSize returns the window size needed to reference
+// all of base from any part of the target.
+func deltaWindowSize(n int) int {
+	if n <= MinWindowSize {
+		return MinWindowSize
+	}
+	if n >= MaxWindowSize {
+		return MaxWindowSize
+	}
+	return 1 << bits.Len(uint(n-1))
+}
@@ -0,0 +1,88 @@
+package zstd
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestEncodeDelta(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, size := range []int{100, 10 << 10, 128 << 10, 1 << 20} {
+		base := make([]byte, size)
+		rng.Read(base)
+		// Change a few bytes and append some.
+		changed := append([]byte(nil), base...)
+		for i := 0; i < 5; i++ {
+			changed[rng.Intn(len(changed))]++
+		}
+		changed = append(changed, "appended"...)
+		for level := speedNotSet + 1; level < speedLast; level++ {
+			if size > 128<<10 && level < SpeedBetterCompression {
+				// Too large to be fully indexed.
+				continue
+			}
+			for name, target := range map[string][]byte{"identical": base, "changed": changed, "tail": base[size/2:]} {
+				patch := EncodeDelta(nil, base, target, level)
+				if name == "identical" && len(patch) > 64+len(target)/1000 {
+					t.Errorf("size %d, level %v: patch of identical input is %d bytes", size, level, len(patch))
+				}
+				if len(patch) > len(target)/2+100 {
+					t.Errorf("size %d, level %v, %s: patch is %d bytes", size, level, name, len(patch))
+				}
+				got, err := DecodeDelta([]byte("prefix"), base, patch)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, append([]byte("prefix"), target...)) {
+					t.Fatalf("size %d, level %v, %s: output mismatch", size, level, name)
+				}
+			}
+		}
+	}
+	// Decoding with another base must not return the target.
+	base := []byte("the quick brown fox jumps over the lazy dog, the quick brown fox jumps over the lazy dog")
+	patch := EncodeDelta(nil, base, base, SpeedDefault)
+	got, err := DecodeDelta(nil, bytes.ToUpper(base), patch)
+	if err == nil && bytes.Equal(got, base) {
+		t.Error("decoded with wrong base")
+	}
+}
+
+func TestEncodeDeltaMagicBase(t *testing.T) {
+	// A base starting with the dictionary magic is still used as raw content.
+	base := append([]byte(dictMagic+"\x01\x02\x03\x04"), "the quick brown fox jumps over the lazy dog"...)
+	target := append(append([]byte(nil), base...), " and the cat"...)
+	patch := EncodeDelta(nil, base, target, SpeedDefault)
+	got, err := DecodeDelta(nil, base, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, target) {
+		t.Error("output mismatch")
+	}
+}
+
+func TestDecodeDeltaPatchFrom(t *testing.T) {
+	// Frame using source.txt as a raw dictionary with ID 0, as written by 'zstd --patch-from'.
+	base, err := os.ReadFile("testdata/delta/source.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := os.ReadFile("testdata/delta/target.txt.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("testdata/delta/target.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeDelta(nil, base, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("mismatch: got %q, want %q", got, want)
+	}
+}
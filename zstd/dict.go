@@ -14,6 +14,8 @@ import (
 
 type dict struct {
 	id uint32
+	// headerID is the ID in the header of raw content that is a complete dictionary, if any.
+	headerID uint32
 
 	litEnc              *huff0.Scratch
 	llDec, ofDec, mlDec sequenceDec
@@ -287,6 +289,11 @@ func BuildDict(o BuildDictOptions) ([]byte, error) {
 				continue
 			}
 			if offset > 3 {
+				// Repeat offsets must be within the dictionary content.
+				// Early matches in small dictionaries can also reference the block itself.
+				if int(offset-3) > len(hist) {
+					continue
+				}
 				newOffsets[offset-3]++
 			} else {
 				newOffsets[uint32(o.Offsets[offset-1])]++
@@ -300,11 +307,11 @@ func BuildDict(o BuildDictOptions) ([]byte, error) {
 	}
 	sort.Slice(sortedOffsets, func(i, j int) bool {
 		a, b := sortedOffsets[i], sortedOffsets[j]
-		if a == b {
+		if newOffsets[a] == newOffsets[b] {
 			// Prefer the longer offset
-			return sortedOffsets[i] > sortedOffsets[j]
+			return a > b
 		}
-		return newOffsets[sortedOffsets[i]] > newOffsets[sortedOffsets[j]]
+		return newOffsets[a] > newOffsets[b]
 	})
 	if len(sortedOffsets) > 3 {
 		if debug {
@@ -336,6 +343,9 @@ func BuildDict(o BuildDictOptions) ([]byte, error) {
 	if seqs/nUsed < 512 {
 		// Use 512 as minimum.
 		nUsed = seqs / 512
+		if nUsed == 0 {
+			nUsed = 1
+		}
 	}
 	copyHist := func(dst *fseEncoder, src *[256]int) ([]byte, error) {
 		hist := dst.Histogram()
@@ -358,6 +368,18 @@ func BuildDict(o BuildDictOptions) ([]byte, error) {
 			fakeLength += v
 			hist[i] = uint32(v)
 		}
+		if maxCount == fakeLength {
+			// Dictionary tables cannot be RLE, so add another symbol.
+			extra := uint8(0)
+			if maxSym == 0 {
+				extra = 1
+			}
+			hist[extra] = 1
+			fakeLength++
+			if extra > maxSym {
+				maxSym = extra
+			}
+		}
 		dst.HistogramFinished(maxSym, maxCount)
 		dst.reUsed = false
 		dst.useRLE = false
@@ -397,6 +419,9 @@ func BuildDict(o BuildDictOptions) ([]byte, error) {
 	if avgSize > huff0.BlockSizeMax/2 {
 		avgSize = huff0.BlockSizeMax / 2
 	}
+	if avgSize < 1 {
+		avgSize = 1
+	}
 	huffBuff := make([]byte, 0, avgSize)
 	// Target size
 	div := litTotal / avgSize
@@ -2,10 +2,13 @@ package zstd
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/klauspost/compress/zip"
@@ -189,6 +192,86 @@ func TestEncoder_SmallDict(t *testing.T) {
 	}
 }
 
+func TestEncoder_EncodeAllDictConcurrent(t *testing.T) {
+	zr := testCreateZipReader("testdata/dict-tests-small.zip", t)
+	var dicts [][]byte
+	var files [][]byte
+	for _, tt := range zr.File {
+		if !strings.HasSuffix(tt.Name, ".dict") && !strings.HasSuffix(tt.Name, ".zst") {
+			continue
+		}
+		if strings.HasSuffix(tt.Name, ".zst") && len(files) >= 20 {
+			continue
+		}
+		r, err := tt.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		in, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(tt.Name, ".dict") {
+			dicts = append(dicts, in)
+			continue
+		}
+		files = append(files, in)
+	}
+	dec, err := NewReader(nil, WithDecoderConcurrency(0), WithDecoderDicts(dicts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	for i, in := range files {
+		files[i], err = dec.DecodeAll(in, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for level := SpeedFastest; level < speedLast; level++ {
+		if (isRaceTest || testing.Short()) && level >= SpeedBestCompression {
+			break
+		}
+		t.Run(level.String(), func(t *testing.T) {
+			opts := []EOption{WithEncoderDict(dicts[0]), WithEncoderLevel(level), WithWindowSize(1 << 17)}
+			ref, err := NewWriter(nil, append(opts, WithEncoderConcurrency(1))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ref.Close()
+			want := make([][]byte, len(files))
+			for i, b := range files {
+				want[i] = ref.EncodeAll(b, nil)
+			}
+			enc, err := NewWriter(nil, append(opts, WithEncoderConcurrency(4))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer enc.Close()
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					var dst []byte
+					for n := 0; n < 2; n++ {
+						for i := range files {
+							i := (i + g*7) % len(files)
+							dst = enc.EncodeAll(files[i], dst[:0])
+							if !bytes.Equal(dst, want[i]) {
+								t.Errorf("file %d: concurrent output differs", i)
+								return
+							}
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+		})
+	}
+}
+
 func TestEncoder_SmallDictFresh(t *testing.T) {
 	// All files have CRC
 	zr := testCreateZipReader("testdata/dict-tests-small.zip", t)
@@ -454,6 +537,80 @@ func BenchmarkEncodeAllDict65536_0(b *testing.B) {
 	benchmarkEncodeAllLimitedBySize(b, 65536, 0)
 }
 
+// BenchmarkDecodeAllDict decodes a small frame using a registered dictionary.
+// Dictionaries are parsed when the decoder is created,
+// so the time per call should be close to decoding without a dictionary.
+func BenchmarkDecodeAllDict(b *testing.B) {
+	zr := testCreateZipReader("testdata/dict-tests-small.zip", b)
+	var dicts [][]byte
+	var frames [][]byte
+	for _, tt := range zr.File {
+		r, err := tt.Open()
+		if err != nil {
+			b.Fatal(err)
+		}
+		in, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		switch {
+		case strings.HasSuffix(tt.Name, ".dict"):
+			dicts = append(dicts, in)
+		case strings.HasSuffix(tt.Name, ".zst"):
+			frames = append(frames, in)
+		}
+	}
+	dec, err := NewReader(nil, WithDecoderConcurrency(1), WithDecoderDicts(dicts...))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer dec.Close()
+	// Find a small frame using a dictionary.
+	var frame, decoded []byte
+	for _, f := range frames {
+		var h Header
+		if err := h.Decode(f); err != nil || h.DictionaryID == 0 {
+			continue
+		}
+		out, err := dec.DecodeAll(f, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(out) > 100 && len(out) < 1000 {
+			frame, decoded = f, out
+			break
+		}
+	}
+	if frame == nil {
+		b.Skip("no small frame with dictionary found")
+	}
+	enc, err := NewWriter(nil, WithEncoderConcurrency(1))
+	if err != nil {
+		b.Fatal(err)
+	}
+	noDict := enc.EncodeAll(decoded, nil)
+	enc.Close()
+	for _, bc := range []struct {
+		name  string
+		frame []byte
+	}{{name: "dict", frame: frame}, {name: "nodict", frame: noDict}} {
+		b.Run(bc.name, func(b *testing.B) {
+			dst := make([]byte, 0, len(decoded))
+			b.SetBytes(int64(len(decoded)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var err error
+				dst, err = dec.DecodeAll(bc.frame, dst[:0])
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func TestDecoder_MoreDicts(t *testing.T) {
 	// All files have CRC
 	// https://files.klauspost.com/compress/zstd-dict-tests.zip
@@ -609,6 +766,43 @@ func readDicts(tb testing.TB, zr *zip.Reader) [][]byte {
 }
 
 // Test decoding of zstd --patch-from output.
+func TestBuildDict_TinyInputs(t *testing.T) {
+	// Few and short samples give few sequences and literals,
+	// and histograms with a single symbol.
+	hist := []byte("abcdefghijklmnopqrstuvwxyz0123456789")
+	tests := map[string][][]byte{
+		"repeated":    {[]byte("abcdefghabcdefghabcdefgh"), []byte("abcdefghabcdefghabcdefgh")},
+		"no-literals": {hist[:16], hist[:16], hist[:16]},
+	}
+	for name, contents := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := BuildDict(BuildDictOptions{ID: 1234, Contents: contents, History: hist, Offsets: [3]int{1, 4, 8}, Level: SpeedDefault})
+			if err != nil {
+				t.Fatal(err)
+			}
+			enc, err := NewWriter(nil, WithEncoderDict(b), WithEncoderConcurrency(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer enc.Close()
+			dec, err := NewReader(nil, WithDecoderDicts(b), WithDecoderConcurrency(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dec.Close()
+			for _, c := range contents {
+				got, err := dec.DecodeAll(enc.EncodeAll(c, nil), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, c) {
+					t.Errorf("roundtrip mismatch for %q", c)
+				}
+			}
+		})
+	}
+}
+
 func TestDecoderRawDict(t *testing.T) {
 	t.Parallel()
 
@@ -642,3 +836,707 @@ func TestDecoderRawDict(t *testing.T) {
 		t.Errorf("mismatch: got %q, wanted %q", out, ref)
 	}
 }
+
+func TestEncoder_DictPool(t *testing.T) {
+	zr := testCreateZipReader("testdata/dict-tests-small.zip", t)
+	dicts := readDicts(t, zr)
+	if len(dicts) < 2 {
+		t.Fatal("need at least 2 dictionaries")
+	}
+	dec, err := NewReader(nil, WithDecoderConcurrency(1), WithDecoderDicts(dicts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	pool, err := NewWriter(nil, WithEncoderConcurrency(1), WithEncoderDictPool(dicts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	var single []*Encoder
+	for _, d := range dicts {
+		enc, err := NewWriter(nil, WithEncoderConcurrency(1), WithEncoderDict(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer enc.Close()
+		single = append(single, enc)
+	}
+	for i, tt := range zr.File {
+		if testing.Short() && i > 20 {
+			break
+		}
+		if !strings.HasSuffix(tt.Name, ".zst") {
+			continue
+		}
+		r, err := tt.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		in, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := dec.DecodeAll(in, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decoded) == 0 {
+			continue
+		}
+		t.Run(tt.Name, func(t *testing.T) {
+			got, id := pool.EncodeAllDict(decoded, nil)
+			for j, enc := range single {
+				if n := len(enc.EncodeAll(decoded, nil)); n < len(got) {
+					t.Errorf("dictionary %d gave %d bytes, pool gave %d", j, n, len(got))
+				}
+			}
+			var fh Header
+			if err := fh.Decode(got); err != nil {
+				t.Fatal(err)
+			}
+			if fh.DictionaryID != id {
+				t.Errorf("frame dictionary ID %d, returned %d", fh.DictionaryID, id)
+			}
+			out, err := dec.DecodeAll(got, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, decoded) {
+				t.Fatal("output mismatch")
+			}
+		})
+	}
+}
+
+func TestDecoder_DictCache(t *testing.T) {
+	zr := testCreateZipReader("testdata/dict-tests-small.zip", t)
+	dicts := readDicts(t, zr)
+	if len(dicts) < 2 {
+		t.Fatal("need at least 2 dictionaries")
+	}
+	var frames [][]byte
+	var want [][]byte
+	for i, d := range dicts[:2] {
+		enc, err := NewWriter(nil, WithEncoderDict(d), WithEncoderConcurrency(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := []byte(fmt.Sprintf("some data using dictionary %d, some data using dictionary %d", i, i))
+		frames = append(frames, enc.EncodeAll(in, nil))
+		want = append(want, in)
+		enc.Close()
+	}
+	dec, err := NewReader(nil, WithDecoderDictCache(1), WithDecoderDicts(dicts[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	check := func(i int) {
+		t.Helper()
+		got, err := dec.DecodeAll(frames[i], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want[i]) {
+			t.Fatalf("frame %d: output mismatch", i)
+		}
+	}
+	check(0)
+	_, err = dec.DecodeAll(frames[1], nil)
+	if !errors.Is(err, ErrUnknownDictionary) {
+		t.Fatalf("want ErrUnknownDictionary, got %v", err)
+	}
+	// The missing ID can be used to find the dictionary and register it.
+	var unknown UnknownDictionaryError
+	if !errors.As(err, &unknown) {
+		t.Fatalf("want UnknownDictionaryError, got %T", err)
+	}
+	if id := frameDictID(t, frames[1]); unknown.ID != id {
+		t.Fatalf("error has id %d, frame uses %d", unknown.ID, id)
+	}
+	var missing []byte
+	for _, d := range dicts {
+		if did, err := loadDict(d); err == nil && did.id == unknown.ID {
+			missing = d
+		}
+	}
+	if err := dec.RegisterDict(missing); err != nil {
+		t.Fatal(err)
+	}
+	check(1)
+	// The first dictionary should be evicted.
+	_, err = dec.DecodeAll(frames[0], nil)
+	if !errors.Is(err, ErrUnknownDictionary) {
+		t.Fatalf("want ErrUnknownDictionary, got %v", err)
+	}
+	// Streams return the same error.
+	if err := dec.Reset(bytes.NewReader(frames[0])); err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(dec)
+	if !errors.As(err, &unknown) || unknown.ID != frameDictID(t, frames[0]) {
+		t.Fatalf("stream: want UnknownDictionaryError with id %d, got %v", frameDictID(t, frames[0]), err)
+	}
+}
+
+// frameDictID returns the dictionary ID of the frame.
+func frameDictID(t *testing.T, frame []byte) uint32 {
+	t.Helper()
+	id, _, err := GetDictID(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestEncoder_ResetDict(t *testing.T) {
+	dict, err := os.ReadFile("testdata/delta/source.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := os.ReadFile("testdata/delta/target.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Mix small messages with ones large enough to move the history.
+	var msgs [][]byte
+	for _, n := range []int{10, 100, 1000, 300 << 10, 50, 2 << 20, 200 << 10, 20, 2 << 20, 1000} {
+		var msg []byte
+		for len(msg) < n {
+			msg = append(msg, target...)
+		}
+		msgs = append(msgs, msg[:n])
+	}
+	dec, err := NewReader(nil, WithDecoderDictRaw(1, dict))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	for level := speedNotSet + 1; level < speedLast; level++ {
+		t.Run(level.String(), func(t *testing.T) {
+			opts := []EOption{WithEncoderLevel(level), WithEncoderConcurrency(1), WithWindowSize(1 << 18), WithEncoderDictRaw(1, dict)}
+			enc, err := NewWriter(nil, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer enc.Close()
+			for i, msg := range msgs {
+				var got bytes.Buffer
+				enc.Reset(&got)
+				if _, err := enc.Write(msg); err != nil {
+					t.Fatal(err)
+				}
+				if err := enc.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				// Output must match a new encoder.
+				var want bytes.Buffer
+				fresh, err := NewWriter(&want, opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := fresh.Write(msg); err != nil {
+					t.Fatal(err)
+				}
+				if err := fresh.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got.Bytes(), want.Bytes()) {
+					t.Fatalf("message %d: output differs from new encoder", i)
+				}
+				if !bytes.Equal(enc.EncodeAll(msg, nil), fresh.EncodeAll(msg, nil)) {
+					t.Fatalf("message %d: EncodeAll output differs from new encoder", i)
+				}
+				decoded, err := dec.DecodeAll(got.Bytes(), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(decoded, msg) {
+					t.Fatalf("message %d: output mismatch", i)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildDict_SmallHistory(t *testing.T) {
+	// Samples repeat themselves at distances larger than the history,
+	// so early matches reference the block and not the history.
+	hist := []byte("hello world!")
+	var contents [][]byte
+	for i := 0; i < 100; i++ {
+		contents = append(contents, []byte(fmt.Sprintf("%03d abcdefghijklmnop abcdefghijklmnop hello world! %03d", i, i)))
+	}
+	b, err := BuildDict(BuildDictOptions{ID: 1234, Contents: contents, History: hist, Offsets: [3]int{1, 4, 8}, Level: SpeedDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := InspectDictionary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range d.Offsets() {
+		if off > len(hist) {
+			t.Errorf("offset %d larger than history %d", off, len(hist))
+		}
+	}
+}
+
+func TestDecoder_DictsMixedFrames(t *testing.T) {
+	zr := testCreateZipReader("testdata/dict-tests-small.zip", t)
+	var dicts [][]byte
+	for _, tt := range zr.File {
+		if !strings.HasSuffix(tt.Name, ".dict") {
+			continue
+		}
+		r, err := tt.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		in, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dicts = append(dicts, in)
+	}
+	if len(dicts) == 0 {
+		t.Fatal("no dictionaries found")
+	}
+	d, err := InspectDictionary(dicts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := append([]byte("mixed frames "), d.Content()...)
+
+	withDict, err := NewWriter(nil, WithEncoderDict(dicts[0]), WithEncoderConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer withDict.Close()
+	plain, err := NewWriter(nil, WithEncoderConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	frames := map[string][]byte{
+		"dict":  withDict.EncodeAll(input, nil),
+		"plain": plain.EncodeAll(input, nil),
+	}
+	var hdr Header
+	if err := hdr.Decode(frames["plain"]); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.DictionaryID != 0 {
+		t.Fatalf("plain frame has dictionary id %d", hdr.DictionaryID)
+	}
+	// Both kinds of frames must decode, alone and concatenated.
+	frames["mixed"] = append(append(append([]byte{}, frames["plain"]...), frames["dict"]...), frames["plain"]...)
+
+	dec, err := NewReader(nil, WithDecoderConcurrency(1), WithDecoderDicts(dicts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	for name, frame := range frames {
+		want := input
+		if name == "mixed" {
+			want = bytes.Repeat(input, 3)
+		}
+		got, err := dec.DecodeAll(frame, nil)
+		if err != nil {
+			t.Fatalf("%s: DecodeAll: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: DecodeAll output mismatch", name)
+		}
+		if err := dec.Reset(bytes.NewReader(frame)); err != nil {
+			t.Fatal(err)
+		}
+		got, err = io.ReadAll(dec)
+		if err != nil {
+			t.Fatalf("%s: stream: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: stream output mismatch", name)
+		}
+	}
+}
+
+func TestDictRegistry(t *testing.T) {
+	zr := testCreateZipReader("testdata/dict-tests-small.zip", t)
+	var dicts [][]byte
+	for _, tt := range zr.File {
+		if !strings.HasSuffix(tt.Name, ".dict") {
+			continue
+		}
+		r, err := tt.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		in, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dicts = append(dicts, in)
+	}
+	if len(dicts) < 2 {
+		t.Fatal("not enough dictionaries found")
+	}
+	reg, err := NewDictRegistry(WithDecoderConcurrency(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	input := []byte(strings.Repeat("dictionary registry test ", 20))
+	var frames [][]byte
+	var ids []uint32
+	for _, d := range dicts[:2] {
+		enc, err := NewWriter(nil, WithEncoderDict(d), WithEncoderConcurrency(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := enc.EncodeAll(input, nil)
+		enc.Close()
+		id, ok, err := GetDictID(frame)
+		if err != nil || !ok {
+			t.Fatalf("no dictionary id in frame: %v", err)
+		}
+		frames = append(frames, frame)
+		ids = append(ids, id)
+	}
+
+	_, err = reg.Decode(frames[0])
+	if !errors.Is(err, ErrUnknownDictionary) || !strings.Contains(err.Error(), fmt.Sprint(ids[0])) {
+		t.Fatalf("want ErrUnknownDictionary naming id %d, got %v", ids[0], err)
+	}
+	for _, d := range dicts[:2] {
+		if err := reg.Register(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	enc, err := NewWriter(nil, WithEncoderConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames = append(frames, enc.EncodeAll(input, nil))
+	enc.Close()
+	for i, frame := range frames {
+		got, err := reg.Decode(frame)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !bytes.Equal(got, input) {
+			t.Fatalf("frame %d: output mismatch", i)
+		}
+	}
+}
+
+func TestEncodeFrames(t *testing.T) {
+	zr := testCreateZipReader("testdata/dict-tests-small.zip", t)
+	var dict []byte
+	for _, tt := range zr.File {
+		if !strings.HasSuffix(tt.Name, ".dict") {
+			continue
+		}
+		r, err := tt.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dict, err = io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+	id, err := InspectDictionary(dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("testdata/delta/target.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := [][]byte{{}}
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	dec, err := NewReader(nil, WithDecoderDicts(dict))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	ref, err := NewWriter(nil, WithEncoderDict(dict), WithEncoderLevel(SpeedDefault), WithEncoderConcurrency(1), WithZeroFrames(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Close()
+	for _, concurrency := range []int{0, 1, 4} {
+		frames, err := EncodeFrames(dict, chunks, SpeedDefault, concurrency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frames) != len(chunks) {
+			t.Fatalf("got %d frames, want %d", len(frames), len(chunks))
+		}
+		for i, frame := range frames {
+			got, ok, err := GetDictID(frame)
+			if len(chunks[i]) == 0 {
+				ok, got = true, id.ID()
+			}
+			if err != nil || !ok || got != id.ID() {
+				t.Fatalf("frame %d: dictionary id %d, want %d (%v)", i, got, id.ID(), err)
+			}
+			if !bytes.Equal(frame, ref.EncodeAll(chunks[i], nil)) {
+				t.Fatalf("frame %d: output differs from EncodeAll", i)
+			}
+			decoded, err := dec.DecodeAll(frame, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, chunks[i]) {
+				t.Fatalf("frame %d: output mismatch", i)
+			}
+		}
+	}
+	if frames, err := EncodeFrames(dict, nil, SpeedDefault, 0); err != nil || len(frames) != 0 {
+		t.Errorf("no chunks: got %d frames, %v", len(frames), err)
+	}
+	if _, err := EncodeFrames(nil, chunks, SpeedDefault, 0); err == nil {
+		t.Error("want error without dictionary")
+	}
+}
+
+func TestDecoderPool(t *testing.T) {
+	zr := testCreateZipReader("testdata/dict-tests-small.zip", t)
+	dicts := readDicts(t, zr)
+	data, err := os.ReadFile("testdata/delta/target.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := make([][]byte, 32)
+	for i := range chunks {
+		chunks[i] = []byte(fmt.Sprintf("chunk %d: %s", i, data))
+	}
+	frames, err := EncodeFrames(dicts[0], chunks, SpeedDefault, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const maxDecoders = 2
+	pool, err := NewDecoderPool(maxDecoders, WithDecoderDicts(dicts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inUse, maxInUse int32
+	var wg sync.WaitGroup
+	errs := make(chan error, len(frames))
+	for i := range frames {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dec, err := pool.Get()
+			if err != nil {
+				errs <- err
+				return
+			}
+			n := atomic.AddInt32(&inUse, 1)
+			for {
+				m := atomic.LoadInt32(&maxInUse)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInUse, m, n) {
+					break
+				}
+			}
+			defer func() {
+				atomic.AddInt32(&inUse, -1)
+				pool.Put(dec)
+			}()
+			if err := dec.Reset(bytes.NewReader(frames[i])); err != nil {
+				errs <- err
+				return
+			}
+			got, err := io.ReadAll(dec)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, chunks[i]) {
+				errs <- fmt.Errorf("frame %d: output mismatch", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if maxInUse > maxDecoders {
+		t.Errorf("%d decoders in use, max is %d", maxInUse, maxDecoders)
+	}
+
+	// Closed decoders are replaced.
+	dec, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec.Close()
+	pool.Put(dec)
+	dec, err = pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dec.DecodeAll(frames[0], nil); err != nil {
+		t.Fatal(err)
+	}
+
+	pool.Close()
+	pool.Put(dec)
+	if _, err := dec.DecodeAll(frames[0], nil); !errors.Is(err, ErrDecoderClosed) {
+		t.Errorf("want decoder closed by Put after Close, got %v", err)
+	}
+	if _, err := pool.Get(); !errors.Is(err, ErrDecoderClosed) {
+		t.Errorf("want ErrDecoderClosed, got %v", err)
+	}
+
+	if _, err := NewDecoderPool(0); err == nil {
+		t.Error("want error for 0 decoders")
+	}
+	if _, err := NewDecoderPool(1, WithDecoderDicts([]byte("not a dictionary"))); err == nil {
+		t.Error("want error for invalid dictionary")
+	}
+}
+
+func TestDecoder_DictIDMismatch(t *testing.T) {
+	zr := testCreateZipReader("testdata/dict-tests-small.zip", t)
+	dicts := readDicts(t, zr)
+	info, err := InspectDictionary(dicts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := NewWriter(nil, WithEncoderDict(dicts[0]), WithEncoderConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	input := []byte("hello hello hello hello, dictionary")
+	frame := enc.EncodeAll(input, nil)
+
+	// A complete dictionary registered as raw content under the wrong ID.
+	wrongID := info.ID() + 1
+	dec, err := NewReader(nil, WithDecoderConcurrency(1), WithDecoderDictRaw(info.ID(), dicts[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	otherInfo, err := InspectDictionary(dicts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dec.DecodeAll(frame, nil)
+	var mismatch ErrDictIDMismatch
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("want ErrDictIDMismatch, got %v", err)
+	}
+	if mismatch.Frame != info.ID() || mismatch.Registered != otherInfo.ID() {
+		t.Errorf("got %+v, want frame %d, registered %d", mismatch, info.ID(), otherInfo.ID())
+	}
+	err = dec.Reset(bytes.NewReader(frame))
+	if err == nil {
+		_, err = io.ReadAll(dec)
+	}
+	if !errors.As(err, &mismatch) {
+		t.Errorf("stream: want ErrDictIDMismatch, got %v", err)
+	}
+
+	// Raw content that is not a dictionary is used as is.
+	dec2, err := NewReader(nil, WithDecoderConcurrency(1), WithDecoderDictRaw(wrongID, info.Content()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec2.Close()
+	enc2, err := NewWriter(nil, WithEncoderDictRaw(wrongID, info.Content()), WithEncoderConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc2.Close()
+	got, err := dec2.DecodeAll(enc2.EncodeAll(input, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, input) {
+		t.Error("output mismatch")
+	}
+}
+
+func TestEncodeSelfContained(t *testing.T) {
+	zr := testCreateZipReader("testdata/dict-tests-small.zip", t)
+	dicts := readDicts(t, zr)
+	data, err := os.ReadFile("testdata/delta/target.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := bytes.Repeat(data, 10)
+	for _, in := range [][]byte{src, {}} {
+		blob, err := EncodeSelfContained(dicts[0], in, SpeedDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(blob[8:8+len(dicts[0])], dicts[0]) {
+			t.Fatal("dictionary not stored after header")
+		}
+		got, err := DecodeSelfContained(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, in) {
+			t.Fatal("output mismatch")
+		}
+	}
+
+	blob, err := EncodeSelfContained(dicts[0], src, SpeedDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The dictionary is a skippable frame, so other decoders only need the dictionary.
+	dec, err := NewReader(nil, WithDecoderConcurrency(1), WithDecoderDicts(dicts[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	got, err := dec.DecodeAll(blob, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, src) {
+		t.Fatal("output mismatch")
+	}
+	plain, err := NewReader(nil, WithDecoderConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if _, err := plain.DecodeAll(blob, nil); !errors.Is(err, ErrUnknownDictionary) {
+		t.Errorf("want ErrUnknownDictionary without dictionary, got %v", err)
+	}
+
+	if _, err := DecodeSelfContained(blob[:100]); err == nil {
+		t.Error("want error for truncated blob")
+	}
+	if _, err := DecodeSelfContained(blob[8+len(dicts[0]):]); !errors.Is(err, ErrMagicMismatch) {
+		t.Errorf("want ErrMagicMismatch for frame, got %v", err)
+	}
+	if _, err := EncodeSelfContained(nil, src, SpeedDefault); err == nil {
+		t.Error("want error without dictionary")
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2019+ Klaus Post. All rights reserved.
+// License information can be found in the LICENSE file.
+
+package zstd
+
+import (
+	"container/list"
+	"sync"
+)
+
+// dictCache contains the dictionaries of a decoder.
+// If max is > 0, the least recently used dictionaries are removed
+// when there are more than max dictionaries.
+// Lookups only take the write lock when the cache is bounded,
+// since they must then update the order of the dictionaries.
+type dictCache struct {
+	mu    sync.RWMutex
+	max   int
+	dicts map[uint32]*list.Element
+	// lru contains the dictionaries, most recently used first.
+	lru list.List
+}
+
+// get returns the dictionary with the specified ID.
+func (c *dictCache) get(id uint32) (*dict, bool) {
+	if c.max <= 0 {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		e, ok := c.dicts[id]
+		if !ok {
+			return nil, false
+		}
+		return e.Value.(*dict), true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.dicts[id]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*dict), true
+}
+
+// add adds a dictionary, replacing any dictionary with the same ID.
+func (c *dictCache) add(d *dict) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dicts == nil {
+		c.dicts = make(map[uint32]*list.Element)
+	}
+	if e, ok := c.dicts[d.id]; ok {
+		e.Value = d
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.dicts[d.id] = c.lru.PushFront(d)
+	if c.max > 0 && c.lru.Len() > c.max {
+		old := c.lru.Back()
+		c.lru.Remove(old)
+		delete(c.dicts, old.Value.(*dict).id)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2019+ Klaus Post. All rights reserved.
+// License information can be found in the LICENSE file.
+
+package zstd
+
+// DictRegistry decodes frames using the dictionary named by the dictionary ID in each frame.
+// Dictionaries can be registered at any time.
+// A DictRegistry is safe for concurrent use.
+type DictRegistry struct {
+	dec *Decoder
+}
+
+// NewDictRegistry returns a DictRegistry with no dictionaries.
+// Decoder options can be supplied, for example to limit memory use.
+func NewDictRegistry(opts ...DOption) (*DictRegistry, error) {
+	dec, err := NewReader(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &DictRegistry{dec: dec}, nil
+}
+
+// Register adds a dictionary in the format of WithDecoderDicts.
+// If a dictionary with the same ID is registered, it is replaced.
+func (r *DictRegistry) Register(dict []byte) error {
+	return r.dec.RegisterDict(dict)
+}
+
+// Decode decodes all frames in input and returns the decoded data.
+// If a frame uses a dictionary that is not registered,
+// an UnknownDictionaryError with the ID is returned.
+// Frames without a dictionary ID are decoded without a dictionary.
+func (r *DictRegistry) Decode(input []byte) ([]byte, error) {
+	id, ok, err := GetDictID(input)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if _, found := r.dec.dicts.get(id); !found {
+			return nil, UnknownDictionaryError{ID: id}
+		}
+	}
+	return r.dec.DecodeAll(input, nil)
+}
+
+// Close releases the resources of the registry.
+// Decode cannot be called after Close.
+func (r *DictRegistry) Close() {
+	r.dec.Close()
+}
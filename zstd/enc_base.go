@@ -23,6 +23,8 @@ type fastBase struct {
 	blk         *blockEnc
 	lastDictID  uint32
 	lowMem      bool
+	// histDict is the dictionary with content at the start of hist, if any.
+	histDict *dict
 }
 
 // CRC returns the underlying CRC writer.
@@ -69,6 +71,7 @@ func (e *fastBase) addBlock(src []byte) int32 {
 				panic(fmt.Errorf("unexpected buffer cap %d, want at least %d with window %d", cap(e.hist), e.maxMatchOff+maxCompressedBlockSize, e.maxMatchOff))
 			}
 			// Move down
+			e.histDict = nil
 			offset := int32(len(e.hist)) - e.maxMatchOff
 			copy(e.hist[0:e.maxMatchOff], e.hist[offset:])
 			e.cur += offset
@@ -100,6 +103,7 @@ func (e *fastBase) ensureHist(n int) {
 		l = int32(n)
 	}
 	e.hist = make([]byte, 0, l)
+	e.histDict = nil
 }
 
 // useBlock will replace the block with the provided one,
@@ -168,6 +172,14 @@ func (e *fastBase) resetBase(d *dict, singleBlock bool) {
 		}
 		// Transfer litenc.
 		e.blk.dictLitEnc = d.litEnc
-		e.hist = append(e.hist, d.content...)
+		if e.histDict == d {
+			// Content is still at the start of hist.
+			e.hist = e.hist[:len(d.content)]
+		} else {
+			e.hist = append(e.hist, d.content...)
+			e.histDict = d
+		}
+	} else {
+		e.histDict = nil
 	}
 }
@@ -26,6 +26,9 @@ type Encoder struct {
 	encoders chan encoder
 	state    encoderState
 	init     sync.Once
+
+	// dictEncoders contains encoders for each dictionary of o.dictPool.
+	dictEncoders []chan encoder
 }
 
 type encoder interface {
@@ -88,10 +91,23 @@ func (e *Encoder) initialize() {
 		enc := e.o.encoder()
 		e.encoders <- enc
 	}
+	if len(e.o.dictPool) > 1 {
+		e.dictEncoders = make([]chan encoder, len(e.o.dictPool))
+		for i, d := range e.o.dictPool {
+			o := e.o
+			o.dict = d
+			e.dictEncoders[i] = make(chan encoder, o.concurrent)
+			for j := 0; j < o.concurrent; j++ {
+				e.dictEncoders[i] <- o.encoder()
+			}
+		}
+	}
 }
 
 // Reset will re-initialize the writer and new writes will encode to the supplied writer
 // as a new, independent stream.
+// Dictionaries set with WithEncoderDict or WithEncoderDictRaw are kept,
+// and only the dictionary tables modified by the previous stream are restored.
 func (e *Encoder) Reset(w io.Writer) {
 	s := &e.state
 	s.wg.Wait()
@@ -464,11 +480,23 @@ func (e *Encoder) Close() error {
 
 // EncodeAll will encode all input in src and append it to dst.
 // This function can be called concurrently, but each call will only run on a single goroutine.
+// This also applies when dictionaries are registered: each concurrent call uses
+// its own encoder state, initialized from the dictionary, which is never modified.
 // If empty input is given, nothing is returned, unless WithZeroFrames is specified.
 // Encoded blocks can be concatenated and the result will be the combined input stream.
 // Data compressed with EncodeAll can be decoded with the Decoder,
 // using either a stream or DecodeAll.
+//
+// If several dictionaries are registered with WithEncoderDictPool,
+// src is encoded with each and the smallest output is used.
 func (e *Encoder) EncodeAll(src, dst []byte) []byte {
+	dst, _ = e.EncodeAllDict(src, dst)
+	return dst
+}
+
+// EncodeAllDict is like EncodeAll, but also returns the ID of the
+// dictionary used for the encode, or 0 if no dictionary was used.
+func (e *Encoder) EncodeAllDict(src, dst []byte) ([]byte, uint32) {
 	if len(src) == 0 {
 		if e.o.fullZero {
 			// Add frame header.
@@ -489,15 +517,42 @@ func (e *Encoder) EncodeAll(src, dst []byte) []byte {
 			blk.setLast(true)
 			dst = blk.appendTo(dst)
 		}
-		return dst
+		return dst, 0
 	}
 	e.init.Do(e.initialize)
-	enc := <-e.encoders
-	defer func() {
+	if len(e.dictEncoders) == 0 {
+		enc := <-e.encoders
+		dst = e.encodeAll(enc, e.o.dict, src, dst)
 		// Release encoder reference to last block.
 		// If a non-single block is needed the encoder will reset again.
 		e.encoders <- enc
-	}()
+		return dst, e.o.dict.ID()
+	}
+
+	// Encode with each dictionary and keep the smallest output.
+	start := len(dst)
+	best := -1
+	var tmp []byte
+	for i, d := range e.o.dictPool {
+		enc := <-e.dictEncoders[i]
+		if best < 0 {
+			dst = e.encodeAll(enc, d, src, dst)
+			best = i
+		} else {
+			tmp = e.encodeAll(enc, d, src, tmp[:0])
+			if len(tmp) < len(dst)-start {
+				dst = append(dst[:start], tmp...)
+				best = i
+			}
+		}
+		e.dictEncoders[i] <- enc
+	}
+	return dst, e.o.dictPool[best].ID()
+}
+
+// encodeAll encodes src using enc with the dictionary d and appends it to dst.
+// enc must have been created for d.
+func (e *Encoder) encodeAll(enc encoder, d *dict, src, dst []byte) []byte {
 	// Use single segments when above minimum window and below window size.
 	single := len(src) <= e.o.windowSize && len(src) > MinWindowSize
 	if e.o.single != nil {
@@ -508,7 +563,7 @@ func (e *Encoder) EncodeAll(src, dst []byte) []byte {
 		WindowSize:    uint32(enc.WindowSize(int64(len(src)))),
 		SingleSegment: single,
 		Checksum:      e.o.crc,
-		DictID:        e.o.dict.ID(),
+		DictID:        d.ID(),
 	}
 
 	// If less than 1MB, allocate a buffer up front.
@@ -519,14 +574,14 @@ func (e *Encoder) EncodeAll(src, dst []byte) []byte {
 
 	// If we can do everything in one block, prefer that.
 	if len(src) <= e.o.blockSize {
-		enc.Reset(e.o.dict, true)
+		enc.Reset(d, true)
 		// Slightly faster with no history and everything in one block.
 		if e.o.crc {
 			_, _ = enc.CRC().Write(src)
 		}
 		blk := enc.Block()
 		blk.last = true
-		if e.o.dict == nil {
+		if d == nil {
 			enc.EncodeNoHist(blk, src)
 		} else {
 			enc.Encode(blk, src)
@@ -545,7 +600,7 @@ func (e *Encoder) EncodeAll(src, dst []byte) []byte {
 		dst = blk.output
 		blk.output = oldout
 	} else {
-		enc.Reset(e.o.dict, false)
+		enc.Reset(d, false)
 		blk := enc.Block()
 		for len(src) > 0 {
 			todo := src
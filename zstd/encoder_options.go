@@ -29,6 +29,7 @@ type encoderOptions struct {
 	customBlockSize bool
 	lowMem          bool
 	dict            *dict
+	dictPool        []*dict
 }
 
 func (o *encoderOptions) setDefault() {
@@ -312,6 +313,9 @@ func WithLowerEncoderMem(b bool) EOption {
 //
 // The encoder *may* choose to use no dictionary instead for certain payloads.
 //
+// An Encoder with a dictionary can be shared by goroutines calling EncodeAll concurrently,
+// so there is no need to create an encoder for each call.
+//
 // [dictionary format]: https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md#dictionary-format
 func WithEncoderDict(dict []byte) EOption {
 	return func(o *encoderOptions) error {
@@ -320,6 +324,7 @@ func WithEncoderDict(dict []byte) EOption {
 			return err
 		}
 		o.dict = d
+		o.dictPool = nil
 		return nil
 	}
 }
@@ -327,13 +332,43 @@ func WithEncoderDict(dict []byte) EOption {
 // WithEncoderDictRaw registers a dictionary that may be used by the encoder.
 //
 // The slice content may contain arbitrary data. It will be used as an initial
-// history.
+// history, with the default repeat offsets and no entropy tables.
+// The id is written to frame headers, unless it is 0,
+// so the decoder must register the same content with WithDecoderDictRaw.
 func WithEncoderDictRaw(id uint32, content []byte) EOption {
 	return func(o *encoderOptions) error {
 		if bits.UintSize > 32 && uint(len(content)) > dictMaxLength {
 			return fmt.Errorf("dictionary of size %d > 2GiB too large", len(content))
 		}
 		o.dict = &dict{id: id, content: content, offsets: [3]int{1, 4, 8}}
+		o.dictPool = nil
+		return nil
+	}
+}
+
+// WithEncoderDictPool registers several dictionaries in the
+// format of WithEncoderDict.
+//
+// EncodeAll will encode the input with each dictionary and use the smallest output.
+// This makes EncodeAll proportionally slower, and uses an encoder for each dictionary.
+// Use EncodeAllDict to get the ID of the dictionary that was used.
+//
+// Streams are encoded using the first dictionary.
+func WithEncoderDictPool(dicts ...[]byte) EOption {
+	return func(o *encoderOptions) error {
+		if len(dicts) == 0 {
+			return errors.New("no dictionaries provided")
+		}
+		pool := make([]*dict, 0, len(dicts))
+		for i, b := range dicts {
+			d, err := loadDict(b)
+			if err != nil {
+				return fmt.Errorf("dictionary %d: %w", i, err)
+			}
+			pool = append(pool, d)
+		}
+		o.dict = pool[0]
+		o.dictPool = pool
 		return nil
 	}
 }
@@ -0,0 +1,62 @@
+// Copyright 2019+ Klaus Post. All rights reserved.
+// License information can be found in the LICENSE file.
+
+package zstd
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// EncodeFrames encodes each chunk as an independent frame using the dictionary,
+// and returns one frame per chunk, in the order of chunks.
+// Chunks are encoded by up to concurrency goroutines.
+// If concurrency is 0, GOMAXPROCS is used.
+//
+// The dictionary must be in the format of WithEncoderDict,
+// and all frames carry its ID, so a decoder with the dictionary registered can decode them
+// independently and in any order.
+// Empty chunks are encoded as empty frames, which do not need the dictionary and carry no ID.
+func EncodeFrames(dict []byte, chunks [][]byte, level EncoderLevel, concurrency int) ([][]byte, error) {
+	if len(dict) == 0 {
+		return nil, errors.New("no dictionary provided")
+	}
+	if concurrency < 0 {
+		return nil, errors.New("concurrency must be at least 0")
+	}
+	if concurrency == 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	if concurrency > len(chunks) {
+		concurrency = len(chunks)
+	}
+	if concurrency == 0 {
+		return [][]byte{}, nil
+	}
+	enc, err := NewWriter(nil, WithEncoderDict(dict), WithEncoderLevel(level), WithEncoderConcurrency(concurrency), WithZeroFrames(true))
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+
+	frames := make([][]byte, len(chunks))
+	var next int64 = -1
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				idx := int(atomic.AddInt64(&next, 1))
+				if idx >= len(chunks) {
+					return
+				}
+				frames[idx] = enc.EncodeAll(chunks[idx], nil)
+			}
+		}()
+	}
+	wg.Wait()
+	return frames, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2019+ Klaus Post. All rights reserved.
+// License information can be found in the LICENSE file.
+
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// selfContainedMagic is the magic number of the skippable frame holding
+// the dictionary of a self-contained blob, using skippable frame ID 0xD.
+const selfContainedMagic = "\x5d" + skippableFrameMagic
+
+// EncodeSelfContained compresses src with the dictionary and returns a blob containing
+// both the dictionary and the compressed data, so it can be decoded with DecodeSelfContained
+// without access to the dictionary. The dictionary must be in the format of WithEncoderDict.
+//
+// The blob is a skippable frame holding the dictionary, followed by a single frame:
+//
+//	Offset  Size  Content
+//	0       4     Magic 0x184D2A5D, little endian
+//	4       4     Length of the dictionary n, little endian
+//	8       n     Dictionary
+//	8+n           Frame compressed with the dictionary
+//
+// Decoders that do not know the format skip the dictionary,
+// and need the dictionary registered to decode the frame.
+// Since the dictionary is stored in every blob, this only saves space when src is large
+// compared to the dictionary.
+func EncodeSelfContained(dict, src []byte, level EncoderLevel) ([]byte, error) {
+	if len(dict) == 0 {
+		return nil, errors.New("no dictionary provided")
+	}
+	if uint64(len(dict)) > dictMaxLength {
+		return nil, fmt.Errorf("dictionary of size %d > 2GiB too large", len(dict))
+	}
+	enc, err := NewWriter(nil, WithEncoderDict(dict), WithEncoderLevel(level), WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+	dst := make([]byte, 0, 8+len(dict)+len(src)/2)
+	dst = append(dst, selfContainedMagic...)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(dict)))
+	dst = append(dst, dict...)
+	return enc.EncodeAll(src, dst), nil
+}
+
+// DecodeSelfContained decodes a blob returned by EncodeSelfContained,
+// using the dictionary stored in the blob.
+// If blob does not start with the dictionary, an error wrapping ErrMagicMismatch is returned.
+func DecodeSelfContained(blob []byte) ([]byte, error) {
+	if len(blob) < 8 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if string(blob[:4]) != selfContainedMagic {
+		return nil, fmt.Errorf("%w: not a self-contained blob", ErrMagicMismatch)
+	}
+	n := binary.LittleEndian.Uint32(blob[4:8])
+	if uint64(len(blob)-8) < uint64(n) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	dict, frame := blob[8:8+n], blob[8+n:]
+	dec, err := NewReader(nil, WithDecoderDicts(dict), WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	return dec.DecodeAll(frame, nil)
+}
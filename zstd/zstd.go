@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
 	"math"
 )
@@ -71,6 +72,7 @@ var (
 	ErrDecoderSizeExceeded = errors.New("decompressed size exceeds configured limit")
 
 	// ErrUnknownDictionary is returned if the dictionary ID is unknown.
+	// Decoders return it as an UnknownDictionaryError with the ID.
 	ErrUnknownDictionary = errors.New("unknown dictionary")
 
 	// ErrFrameSizeExceeded is returned if the stated frame size is exceeded.
@@ -93,6 +95,40 @@ var (
 	ErrDecoderNilInput = errors.New("nil input provided as reader")
 )
 
+// ErrDictIDMismatch is returned when a frame uses a dictionary registered with
+// WithDecoderDictRaw with a non-zero ID, and the content is a complete dictionary with a different ID.
+// This usually means the wrong dictionary was registered for the ID,
+// and decoding would produce corrupt output.
+type ErrDictIDMismatch struct {
+	// Frame is the dictionary ID of the frame.
+	Frame uint32
+	// Registered is the ID in the header of the registered dictionary.
+	Registered uint32
+}
+
+// Error returns the error as string.
+func (e ErrDictIDMismatch) Error() string {
+	return fmt.Sprintf("dictionary id mismatch: frame uses id %d, registered dictionary has id %d", e.Frame, e.Registered)
+}
+
+// UnknownDictionaryError is returned when a frame uses a dictionary that is not registered.
+// It matches ErrUnknownDictionary with errors.Is.
+// The dictionary can be registered with Decoder.RegisterDict before decoding the frame again.
+type UnknownDictionaryError struct {
+	// ID is the dictionary ID of the frame.
+	ID uint32
+}
+
+// Error returns the error as string.
+func (e UnknownDictionaryError) Error() string {
+	return fmt.Sprintf("%v: id %d", ErrUnknownDictionary, e.ID)
+}
+
+// Is returns whether target is ErrUnknownDictionary.
+func (e UnknownDictionaryError) Is(target error) bool {
+	return target == ErrUnknownDictionary
+}
+
 func println(a ...interface{}) {
 	if debug || debugDecoder || debugEncoder {
 		log.Println(a...)